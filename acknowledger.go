@@ -0,0 +1,87 @@
+package mq
+
+// WrapAcknowledger returns an Acknowledger settling the jobs with w, a
+// wrapper of the Acknowledger a, that keeps implementing the optional
+// interfaces of a, Extender and ProgressReporter, unless w implements them
+// itself. It's meant to be used by the JobIters wrapping the Acknowledgers of
+// their jobs, so the wrappers can be stacked in any order.
+func WrapAcknowledger(a, w Acknowledger) Acknowledger {
+	base := &wrappedAcknowledger{w: w, a: a}
+	e, extends := w.(Extender)
+	if !extends {
+		e, extends = a.(Extender)
+	}
+
+	p, reports := w.(ProgressReporter)
+	if !reports {
+		p, reports = a.(ProgressReporter)
+	}
+
+	switch {
+	case extends && reports:
+		return &struct {
+			*wrappedAcknowledger
+			Extender
+			ProgressReporter
+		}{base, e, p}
+	case extends:
+		return &struct {
+			*wrappedAcknowledger
+			Extender
+		}{base, e}
+	case reports:
+		return &struct {
+			*wrappedAcknowledger
+			ProgressReporter
+		}{base, p}
+	default:
+		return base
+	}
+}
+
+// FindAcknowledger walks the chain of Acknowledgers built with
+// WrapAcknowledger, from the outermost wrapper, and returns the first one for
+// which match returns true.
+func FindAcknowledger(a Acknowledger, match func(Acknowledger) bool) (Acknowledger, bool) {
+	for a != nil {
+		u, ok := a.(unwrapper)
+		if !ok {
+			if match(a) {
+				return a, true
+			}
+
+			break
+		}
+
+		w, inner := u.unwrap()
+		if match(w) {
+			return w, true
+		}
+
+		a = inner
+	}
+
+	return nil, false
+}
+
+type unwrapper interface {
+	unwrap() (w, a Acknowledger)
+}
+
+type wrappedAcknowledger struct {
+	w, a Acknowledger
+}
+
+// Ack implements the Acknowledger interface.
+func (a *wrappedAcknowledger) Ack() error {
+	return a.w.Ack()
+}
+
+// Reject implements the Acknowledger interface.
+func (a *wrappedAcknowledger) Reject(requeue bool) error {
+	return a.w.Reject(requeue)
+}
+
+func (a *wrappedAcknowledger) unwrap() (Acknowledger, Acknowledger) {
+	return a.w, a.a
+}
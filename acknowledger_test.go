@@ -0,0 +1,98 @@
+package mq_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testAcknowledger struct {
+	acked    bool
+	extended time.Duration
+}
+
+func (a *testAcknowledger) Ack() error {
+	a.acked = true
+	return nil
+}
+
+func (a *testAcknowledger) Reject(bool) error {
+	return nil
+}
+
+func (a *testAcknowledger) Extend(d time.Duration) error {
+	a.extended = d
+	return nil
+}
+
+type countingAcknowledger struct {
+	mq.Acknowledger
+	acks int
+}
+
+func (a *countingAcknowledger) Ack() error {
+	a.acks++
+	return a.Acknowledger.Ack()
+}
+
+type progressAcknowledger struct {
+	mq.Acknowledger
+	percent float64
+}
+
+func (a *progressAcknowledger) ReportProgress(percent float64, _ string) error {
+	a.percent = percent
+	return nil
+}
+
+func TestWrapAcknowledger(t *testing.T) {
+	require := require.New(t)
+
+	inner := &testAcknowledger{}
+	progress := &progressAcknowledger{Acknowledger: inner}
+	j := &mq.Job{Acknowledger: mq.WrapAcknowledger(inner, progress)}
+
+	counting := &countingAcknowledger{Acknowledger: j.Acknowledger}
+	j.Acknowledger = mq.WrapAcknowledger(j.Acknowledger, counting)
+
+	require.True(j.CanExtend())
+	require.NoError(j.Extend(time.Minute))
+	require.Equal(time.Minute, inner.extended)
+
+	require.NoError(j.ReportProgress(50, "half"))
+	require.Equal(50.0, progress.percent)
+
+	require.NoError(j.Ack())
+	require.True(inner.acked)
+	require.Equal(1, counting.acks)
+
+	found, ok := mq.FindAcknowledger(j.Acknowledger, func(a mq.Acknowledger) bool {
+		_, ok := a.(*progressAcknowledger)
+		return ok
+	})
+	require.True(ok)
+	require.Equal(progress, found)
+
+	found, ok = mq.FindAcknowledger(j.Acknowledger, func(a mq.Acknowledger) bool {
+		return a == inner
+	})
+	require.True(ok)
+	require.Equal(inner, found)
+
+	_, ok = mq.FindAcknowledger(j.Acknowledger, func(a mq.Acknowledger) bool {
+		return false
+	})
+	require.False(ok)
+}
+
+func TestWrapAcknowledger_not_supported(t *testing.T) {
+	require := require.New(t)
+
+	inner := &countingAcknowledger{Acknowledger: &testAcknowledger{}}
+	j := &mq.Job{Acknowledger: mq.WrapAcknowledger(inner, &countingAcknowledger{Acknowledger: inner})}
+	require.False(j.CanExtend())
+	require.True(mq.ErrProgressNotSupported.Is(j.ReportProgress(50, "")))
+}
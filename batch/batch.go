@@ -0,0 +1,235 @@
+// Package batch implements batches of jobs: groups of jobs tracked together,
+// whose completion enqueues a callback job.
+//
+// The jobs of a batch carry its ID in their headers. A Manager is an mq.Hook:
+// once added to a broker with mq.AddHook, it counts the jobs of every batch
+// acknowledged, buried or canceled in its queues. When all the jobs of a
+// sealed batch are finished, the callback job of the batch is published.
+package batch
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+
+	"github.com/google/uuid"
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// Names of the job headers of the batches.
+const (
+	// BatchIDHeader is the ID of the batch of a job.
+	BatchIDHeader = "batch-id"
+	// CallbackHeader is the ID of the batch of a callback job.
+	CallbackHeader = "batch-callback"
+	// SucceededHeader, FailedHeader and CanceledHeader are the number of jobs
+	// acknowledged, buried and canceled of the batch of a callback job.
+	SucceededHeader = "batch-succeeded"
+	FailedHeader    = "batch-failed"
+	CanceledHeader  = "batch-canceled"
+)
+
+var (
+	// ErrNotFound is returned when a batch does not exist.
+	ErrNotFound = errors.NewKind("batch %s not found")
+	// ErrSealed is returned when publishing to a sealed batch.
+	ErrSealed = errors.NewKind("batch %s is sealed")
+)
+
+// Batch is the state of a batch.
+type Batch struct {
+	ID string
+	// Total is the number of jobs published.
+	Total int
+	// Succeeded is the number of jobs acknowledged.
+	Succeeded int
+	// Failed is the number of jobs buried or dead-lettered.
+	Failed int
+	// Canceled is the number of jobs canceled before finishing.
+	Canceled int
+	// Sealed is true once no more jobs can be published.
+	Sealed bool
+	// CallbackQueue and Callback are the queue and the job published when the
+	// batch completes.
+	CallbackQueue string
+	Callback      *mq.Job
+	// Error is the error publishing the callback job, if it failed.
+	Error     string
+	Created   time.Time
+	Completed time.Time
+}
+
+// Pending returns the number of jobs not finished yet.
+func (b *Batch) Pending() int {
+	return b.Total - b.Succeeded - b.Failed - b.Canceled
+}
+
+// Progress returns the fraction of jobs finished, between 0 and 1.
+func (b *Batch) Progress() float64 {
+	if b.Total == 0 {
+		return 0
+	}
+
+	return float64(b.Total-b.Pending()) / float64(b.Total)
+}
+
+// Done returns true if the batch is sealed and all its jobs are finished.
+func (b *Batch) Done() bool {
+	return b.Sealed && b.Pending() == 0
+}
+
+// Manager creates batches and tracks their jobs.
+type Manager struct {
+	b mq.Broker
+	s Store
+}
+
+// NewManager returns a Manager publishing the callback jobs to the queues of
+// the given Broker and keeping the state of the batches in the Store.
+func NewManager(b mq.Broker, s Store) *Manager {
+	return &Manager{b: b, s: s}
+}
+
+// Create creates a new batch, whose callback job is published to the given
+// queue when it completes. The callback is optional.
+func (m *Manager) Create(queue string, callback *mq.Job) (string, error) {
+	b := &Batch{
+		ID:            uuid.New().String(),
+		CallbackQueue: queue,
+		Callback:      callback,
+		Created:       time.Now(),
+	}
+
+	if err := m.s.Create(b); err != nil {
+		return "", err
+	}
+
+	return b.ID, nil
+}
+
+// Publish publishes the job to the queue as part of the batch. If the queue
+// implements mq.Deduplicator and reports the job as a duplicate, it's not
+// counted in the batch.
+func (m *Manager) Publish(id string, q mq.Queue, j *mq.Job) error {
+	if j == nil {
+		return q.Publish(j)
+	}
+
+	err := m.s.Update(id, func(b *Batch) error {
+		if b.Sealed {
+			return ErrSealed.New(id)
+		}
+
+		b.Total++
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	headers := make(map[string]string, len(j.Headers)+1)
+	for k, v := range j.Headers {
+		headers[k] = v
+	}
+
+	headers[BatchIDHeader] = id
+	j.Headers = headers
+
+	duplicate, err := mq.PublishDedup(q, j)
+	if err != nil || duplicate {
+		m.update(id, func(b *Batch) { b.Total-- })
+	}
+
+	return err
+}
+
+// Seal marks the batch as complete, no more jobs can be published to it.
+// The callback job is published once all its jobs are finished, right away
+// if they already are.
+func (m *Manager) Seal(id string) error {
+	return m.update(id, func(b *Batch) { b.Sealed = true })
+}
+
+// Progress returns the current state of the batch.
+func (m *Manager) Progress(id string) (*Batch, error) {
+	return m.s.Get(id)
+}
+
+// OnEvent implements the mq.Hook interface. The errors of the Store are
+// ignored, the hooks can't fail. The jobs of the dead-letter queues are not
+// tracked, they already counted as failed.
+func (m *Manager) OnEvent(e mq.Event) {
+	if e.Job == nil || e.Job.DeadLetterOrigin != "" {
+		return
+	}
+
+	id := e.Job.Headers[BatchIDHeader]
+	if id == "" {
+		return
+	}
+
+	switch e.Transition {
+	case mq.Acked:
+		if e.Err == nil {
+			m.update(id, func(b *Batch) { b.Succeeded++ })
+		}
+	case mq.Buried:
+		// whatever the reason, such as an expired lease
+		m.update(id, func(b *Batch) { b.Failed++ })
+	case mq.Canceled:
+		m.update(id, func(b *Batch) { b.Canceled++ })
+	}
+}
+
+// update applies fn to the batch and publishes the callback job if the batch
+// is done.
+func (m *Manager) update(id string, fn func(*Batch)) error {
+	var done *Batch
+	err := m.s.Update(id, func(b *Batch) error {
+		done = nil
+		fn(b)
+		if b.Done() && b.Completed.IsZero() {
+			b.Completed = time.Now()
+			c := *b
+			done = &c
+		}
+
+		return nil
+	})
+
+	if err != nil || done == nil || done.Callback == nil {
+		return err
+	}
+
+	if err := m.callback(done); err != nil {
+		m.s.Update(id, func(b *Batch) error {
+			b.Error = err.Error()
+			return nil
+		})
+
+		return err
+	}
+
+	return nil
+}
+
+func (m *Manager) callback(b *Batch) error {
+	q, err := m.b.Queue(b.CallbackQueue)
+	if err != nil {
+		return err
+	}
+
+	j := *b.Callback
+	j.Headers = make(map[string]string, len(b.Callback.Headers)+4)
+	for k, v := range b.Callback.Headers {
+		j.Headers[k] = v
+	}
+
+	j.Headers[CallbackHeader] = b.ID
+	j.Headers[SucceededHeader] = strconv.Itoa(b.Succeeded)
+	j.Headers[FailedHeader] = strconv.Itoa(b.Failed)
+	j.Headers[CanceledHeader] = strconv.Itoa(b.Canceled)
+	return q.Publish(&j)
+}
@@ -0,0 +1,196 @@
+package batch
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+	"github.com/go-mq/mq/v2/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	m := NewManager(b, NewMemoryStore())
+	b = mq.AddHook(b, m)
+
+	id, err := m.Create("finalize", test.NewJob(t, "finalize"))
+	require.NoError(err)
+
+	q, err := b.Queue("work")
+	require.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(m.Publish(id, q, test.NewJob(t, strconv.Itoa(i))))
+	}
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	for i := 0; i < 10; i++ {
+		j, err := iter.Next()
+		require.NoError(err)
+		require.Equal(id, j.Headers[BatchIDHeader])
+
+		switch {
+		case i == 0:
+			// requeued jobs are not finished
+			require.NoError(j.Reject(true))
+		case i%3 == 0:
+			require.NoError(j.Reject(false))
+		default:
+			// acknowledging twice counts once
+			require.NoError(j.Ack())
+			require.NoError(j.Ack())
+		}
+	}
+
+	p, err := m.Progress(id)
+	require.NoError(err)
+	require.Equal(10, p.Total)
+	require.Equal(6, p.Succeeded)
+	require.Equal(3, p.Failed)
+	require.Equal(1, p.Pending())
+	require.Equal(0.9, p.Progress())
+	require.False(p.Done())
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.NoError(j.Ack())
+
+	// the batch is not done until it's sealed
+	requireEmpty(t, b, "finalize")
+	require.NoError(m.Seal(id))
+	require.True(ErrSealed.Is(m.Publish(id, q, test.NewJob(t, "late"))))
+
+	p, err = m.Progress(id)
+	require.NoError(err)
+	require.True(p.Done())
+	require.False(p.Completed.IsZero())
+
+	fq, err := b.Queue("finalize")
+	require.NoError(err)
+	fiter, err := fq.Consume(0)
+	require.NoError(err)
+	defer fiter.Close()
+
+	j, err = fiter.Next()
+	require.NoError(err)
+
+	var payload string
+	require.NoError(j.Decode(&payload))
+	require.Equal("finalize", payload)
+	require.Equal(id, j.Headers[CallbackHeader])
+	require.Equal("7", j.Headers[SucceededHeader])
+	require.Equal("3", j.Headers[FailedHeader])
+	require.Empty(j.Headers[BatchIDHeader])
+	require.NoError(j.Ack())
+
+	_, err = m.Progress("unknown")
+	require.True(ErrNotFound.Is(err))
+}
+
+func TestBatch_canceled(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	m := NewManager(b, NewMemoryStore())
+	b = mq.AddHook(b, m)
+
+	id, err := m.Create("finalize", test.NewJob(t, "finalize"))
+	require.NoError(err)
+
+	q, err := b.Queue("work-canceled")
+	require.NoError(err)
+
+	var jobs []*mq.Job
+	for i := 0; i < 2; i++ {
+		j := test.NewJob(t, strconv.Itoa(i))
+		require.NoError(m.Publish(id, q, j))
+		jobs = append(jobs, j)
+	}
+
+	require.NoError(m.Seal(id))
+	for _, j := range jobs {
+		ok, err := mq.Cancel(q, j.ID)
+		require.NoError(err)
+		require.True(ok)
+	}
+
+	p, err := m.Progress(id)
+	require.NoError(err)
+	require.Equal(2, p.Canceled)
+	require.True(p.Done())
+
+	fq, err := b.Queue("finalize")
+	require.NoError(err)
+	iter, err := fq.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Equal("2", j.Headers[CanceledHeader])
+}
+
+func TestBatch_duplicate(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	m := NewManager(b, NewMemoryStore())
+
+	id, err := m.Create("finalize", nil)
+	require.NoError(err)
+
+	q, err := b.Queue("work-dedup")
+	require.NoError(err)
+	q.(*memory.Queue).SetDedupWindow(time.Minute)
+
+	j := test.NewJob(t, "once")
+	j.DedupKey = "once"
+	require.NoError(m.Publish(id, q, j))
+
+	dup := test.NewJob(t, "once")
+	dup.DedupKey = "once"
+	require.NoError(m.Publish(id, q, dup))
+
+	p, err := m.Progress(id)
+	require.NoError(err)
+	require.Equal(1, p.Total)
+}
+
+func TestBatch_empty(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	m := NewManager(b, NewMemoryStore())
+
+	id, err := m.Create("finalize", test.NewJob(t, "finalize"))
+	require.NoError(err)
+	require.NoError(m.Seal(id))
+
+	q, err := b.Queue("finalize")
+	require.NoError(err)
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Equal(id, j.Headers[CallbackHeader])
+}
+
+func requireEmpty(t *testing.T, b mq.Broker, queue string) {
+	q, err := b.Queue(queue)
+	require.NoError(t, err)
+
+	stats, err := q.(mq.Inspector).Stats()
+	require.NoError(t, err)
+	require.Equal(t, mq.QueueStats{}, stats)
+}
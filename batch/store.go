@@ -0,0 +1,71 @@
+package batch
+
+import "sync"
+
+// Store keeps the state of the batches.
+type Store interface {
+	// Create saves a new batch.
+	Create(*Batch) error
+	// Get returns a copy of the batch, or ErrNotFound.
+	Get(id string) (*Batch, error)
+	// Update applies fn to the batch and saves it atomically. If fn returns
+	// an error, nothing is saved and the error is returned.
+	Update(id string, fn func(*Batch) error) error
+}
+
+// NewMemoryStore returns a Store keeping the batches in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{batches: make(map[string]*Batch)}
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	batches map[string]*Batch
+}
+
+// Create implements the Store interface.
+func (s *memoryStore) Create(b *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches[b.ID] = clone(b)
+	return nil
+}
+
+// Get implements the Store interface.
+func (s *memoryStore) Get(id string) (*Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.batches[id]
+	if !ok {
+		return nil, ErrNotFound.New(id)
+	}
+
+	return clone(b), nil
+}
+
+// Update implements the Store interface.
+func (s *memoryStore) Update(id string, fn func(*Batch) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.batches[id]
+	if !ok {
+		return ErrNotFound.New(id)
+	}
+
+	c := clone(b)
+	if err := fn(c); err != nil {
+		return err
+	}
+
+	s.batches[id] = c
+	return nil
+}
+
+// clone returns a copy of the batch, the callback job is shared but it's
+// never modified.
+func clone(b *Batch) *Batch {
+	c := *b
+	return &c
+}
@@ -0,0 +1,483 @@
+// Package breaker implements a circuit breaker for job consumers. When the
+// rate of failed jobs is too high, usually because a dependency is down, the
+// breaker opens and the consumers stop taking jobs from the queue until it
+// closes again, instead of failing every job and burning their retries.
+package breaker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+)
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	// Closed lets every job through, counting their outcomes.
+	Closed State = iota
+	// Open does not let any job through until the open timeout passes.
+	Open
+	// HalfOpen lets a few jobs through to probe whether the failures
+	// stopped.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Settings configures a Breaker.
+type Settings struct {
+	// FailureRate is the rate of failed jobs, from 0 to 1, that opens the
+	// breaker.
+	FailureRate float64
+	// MinJobs is the minimum number of jobs within the window needed to
+	// open the breaker.
+	MinJobs int
+	// Window is the period of time the outcomes of the jobs are counted in.
+	// Use 0 to count them until the breaker opens.
+	Window time.Duration
+	// OpenTimeout is how long the breaker stays open before half-opening.
+	// It is also how long a probe can go without being acknowledged or
+	// rejected before another job is let through in its place, the breaker
+	// never opens again on time alone.
+	OpenTimeout time.Duration
+	// Probes is the number of jobs let through at the same time while
+	// half-open, as many successes are needed to close the breaker and a
+	// single failure opens it again. Defaults to 1.
+	Probes int
+	// OnStateChange, if not nil, is called on every change of state.
+	OnStateChange func(from, to State)
+}
+
+// Metrics are the counters of a Breaker.
+type Metrics struct {
+	// State is the current state.
+	State State
+	// Successes is the number of jobs acknowledged.
+	Successes uint64
+	// Failures is the number of jobs rejected.
+	Failures uint64
+	// Requeued is the number of jobs requeued because the breaker was not
+	// letting jobs through, or because they were in flight when it opened.
+	Requeued uint64
+	// Trips is the number of times the breaker opened.
+	Trips uint64
+}
+
+// Breaker is a circuit breaker, it can be shared by many iterators.
+type Breaker struct {
+	s Settings
+
+	mu       sync.Mutex
+	state    State
+	changed  chan struct{}
+	openedAt time.Time
+	// windowStart, successes and failures count the outcomes within the
+	// current window, probes the jobs delivered while half-open and not
+	// settled yet. gen changes with every change of state, so the outcome of
+	// a job is only counted in the state it was let through in.
+	windowStart time.Time
+	successes   int
+	failures    int
+	probes      int
+	gen         uint64
+	metrics     Metrics
+	// inFlight are the jobs let through by the wrapped iterators and not
+	// settled yet, requeued when the breaker opens.
+	inFlight map[*acknowledger]struct{}
+	// transitions are the changes of state to notify, and requeue the jobs
+	// to requeue, when unlocking.
+	transitions [][2]State
+	requeue     []*acknowledger
+}
+
+// New returns a new closed Breaker with the given Settings.
+func New(s Settings) *Breaker {
+	if s.Probes < 1 {
+		s.Probes = 1
+	}
+
+	return &Breaker{
+		s:           s,
+		changed:     make(chan struct{}),
+		windowStart: time.Now(),
+		inFlight:    make(map[*acknowledger]struct{}),
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.unlock()
+	b.update(time.Now())
+	return b.state
+}
+
+// Metrics returns the current metrics of the breaker.
+func (b *Breaker) Metrics() Metrics {
+	b.mu.Lock()
+	defer b.unlock()
+	b.update(time.Now())
+	m := b.metrics
+	m.State = b.state
+	return m
+}
+
+// Success records a successful job.
+func (b *Breaker) Success() {
+	b.record(true)
+}
+
+// Failure records a failed job.
+func (b *Breaker) Failure() {
+	b.record(false)
+}
+
+func (b *Breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.unlock()
+	now := time.Now()
+	b.update(now)
+	b.count(success, now)
+}
+
+// count records an outcome in the current state. Must be called with the
+// lock held.
+func (b *Breaker) count(success bool, now time.Time) {
+	b.tally(success)
+
+	switch b.state {
+	case Closed:
+		if b.s.Window > 0 && now.Sub(b.windowStart) >= b.s.Window {
+			b.windowStart, b.successes, b.failures = now, 0, 0
+		}
+
+		if success {
+			b.successes++
+		} else {
+			b.failures++
+		}
+
+		total := b.successes + b.failures
+		if total >= b.s.MinJobs &&
+			float64(b.failures)/float64(total) >= b.s.FailureRate && b.failures > 0 {
+			b.set(Open, now)
+		}
+	case HalfOpen:
+		if !success {
+			b.set(Open, now)
+		} else if b.successes++; b.successes >= b.s.Probes {
+			b.set(Closed, now)
+		}
+	}
+}
+
+// tally adds an outcome to the metrics. Must be called with the lock held.
+func (b *Breaker) tally(success bool) {
+	if success {
+		b.metrics.Successes++
+	} else {
+		b.metrics.Failures++
+	}
+}
+
+// wait blocks until a job is allowed through or the context is done.
+func (b *Breaker) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.update(now)
+
+		var (
+			retry   <-chan time.Time
+			timer   *time.Timer
+			allowed bool
+		)
+
+		switch b.state {
+		case Closed:
+			allowed = true
+		case HalfOpen:
+			// the probes taken may never finish
+			next, ok := b.expireProbes(now)
+			if b.probes < b.s.Probes {
+				allowed = true
+			} else if ok {
+				timer = time.NewTimer(next.Sub(now))
+				retry = timer.C
+			}
+		case Open:
+			timer = time.NewTimer(b.openedAt.Add(b.s.OpenTimeout).Sub(now))
+			retry = timer.C
+		}
+
+		changed := b.changed
+		b.unlock()
+
+		if allowed {
+			return nil
+		}
+
+		var err error
+		select {
+		case <-changed:
+		case <-retry:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// expireProbes frees the slots of the probes not settled within the open
+// timeout, so other jobs can be let through in their place. It returns when
+// the next probe expires, if there is any. Must be called with the lock held.
+func (b *Breaker) expireProbes(now time.Time) (time.Time, bool) {
+	var (
+		next time.Time
+		ok   bool
+	)
+
+	for a := range b.inFlight {
+		if !a.probe {
+			continue
+		}
+
+		expires := a.since.Add(b.s.OpenTimeout)
+		if !now.Before(expires) {
+			a.probe = false
+			b.probes--
+			continue
+		}
+
+		if !ok || expires.Before(next) {
+			next, ok = expires, true
+		}
+	}
+
+	return next, ok
+}
+
+// admit decides whether a job taken from the queue by a wrapped iterator is
+// let through, counting it as a probe while half-open. It returns false if
+// the breaker is open or all the probes are already taken.
+func (b *Breaker) admit(a *acknowledger) bool {
+	b.mu.Lock()
+	defer b.unlock()
+	now := time.Now()
+	b.update(now)
+
+	switch b.state {
+	case Open:
+		b.metrics.Requeued++
+		return false
+	case HalfOpen:
+		if b.probes >= b.s.Probes {
+			b.metrics.Requeued++
+			return false
+		}
+
+		b.probes++
+		a.probe = true
+	}
+
+	a.gen, a.since = b.gen, now
+	b.inFlight[a] = struct{}{}
+	return true
+}
+
+// settle acknowledges or rejects a job let through by a wrapped iterator with
+// the given function, recording its outcome once it succeeded. It does
+// nothing if the job was already settled, or requeued because the breaker
+// opened.
+func (b *Breaker) settle(a *acknowledger, success bool, fn func() error) error {
+	b.mu.Lock()
+	if _, ok := b.inFlight[a]; !ok {
+		b.unlock()
+		return nil
+	}
+
+	delete(b.inFlight, a)
+	b.unlock()
+
+	err := fn()
+
+	b.mu.Lock()
+	defer b.unlock()
+	now := time.Now()
+	b.update(now)
+	current := a.gen == b.gen
+	if current && a.probe {
+		b.probes--
+	}
+
+	switch {
+	case err != nil:
+		// the outcome is unknown, let another probe through
+		if current && a.probe {
+			b.notify()
+		}
+	case current:
+		b.count(success, now)
+	default:
+		// the breaker changed state in the meantime, the outcome says
+		// nothing about the current one
+		b.tally(success)
+	}
+
+	return err
+}
+
+// update half-opens the breaker if the open timeout passed. Must be called
+// with the lock held.
+func (b *Breaker) update(now time.Time) {
+	if b.state == Open && !now.Before(b.openedAt.Add(b.s.OpenTimeout)) {
+		b.set(HalfOpen, now)
+	}
+}
+
+// notify wakes up the iterators waiting for the breaker. Must be called with
+// the lock held.
+func (b *Breaker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// set changes the state of the breaker. Must be called with the lock held.
+func (b *Breaker) set(state State, now time.Time) {
+	b.transitions = append(b.transitions, [2]State{b.state, state})
+	b.state = state
+	b.gen++
+	b.windowStart, b.successes, b.failures, b.probes = now, 0, 0, 0
+	if state == Open {
+		b.openedAt = now
+		b.metrics.Trips++
+		for a := range b.inFlight {
+			b.requeue = append(b.requeue, a)
+			delete(b.inFlight, a)
+		}
+
+		b.metrics.Requeued += uint64(len(b.requeue))
+	}
+
+	b.notify()
+}
+
+// unlock releases the lock, requeues the jobs in flight when the breaker
+// opened and calls OnStateChange with the changes of state made while
+// holding it.
+func (b *Breaker) unlock() {
+	transitions, requeue := b.transitions, b.requeue
+	b.transitions, b.requeue = nil, nil
+	b.mu.Unlock()
+
+	for _, a := range requeue {
+		// the jobs whose lease expired are already back in the queue
+		a.Acknowledger.Reject(true)
+	}
+
+	if b.s.OnStateChange == nil {
+		return
+	}
+
+	for _, t := range transitions {
+		b.s.OnStateChange(t[0], t[1])
+	}
+}
+
+// Wrap returns a JobIter that stops taking jobs from the given one while the
+// breaker is open, blocking in Next until it half-opens. Acknowledged jobs
+// count as successes and rejected ones as failures.
+//
+// Jobs are requeued without being counted as failures if they are taken from
+// the queue while the breaker is open, or while half-open with all the probes
+// taken, or if they are still being processed when it opens, so they are not
+// buried because of the outage. Acknowledging or rejecting a job requeued
+// that way does nothing. An acknowledgement or rejection that fails is not
+// counted either.
+func (b *Breaker) Wrap(iter mq.JobIter) mq.JobIter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobIter{JobIter: iter, b: b, ctx: ctx, cancel: cancel}
+}
+
+type jobIter struct {
+	mq.JobIter
+	b      *Breaker
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Next implements the mq.JobIter interface.
+func (i *jobIter) Next() (*mq.Job, error) {
+	for {
+		if err := i.b.wait(i.ctx); err != nil {
+			return nil, mq.ErrAlreadyClosed.New()
+		}
+
+		j, err := i.JobIter.Next()
+		if err != nil || j == nil {
+			return j, err
+		}
+
+		a := &acknowledger{Acknowledger: j.Acknowledger, b: i.b}
+		if !i.b.admit(a) {
+			if err := j.Reject(true); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		j.Acknowledger = mq.WrapAcknowledger(j.Acknowledger, a)
+		return j, nil
+	}
+}
+
+// Close implements the mq.JobIter interface.
+func (i *jobIter) Close() error {
+	i.cancel()
+	return i.JobIter.Close()
+}
+
+type acknowledger struct {
+	mq.Acknowledger
+	b *Breaker
+	// gen and since are the state and time the job was let through in,
+	// probe whether it holds one of the probe slots. Guarded by the lock of
+	// the breaker.
+	gen   uint64
+	since time.Time
+	probe bool
+}
+
+// Ack implements the mq.Acknowledger interface.
+func (a *acknowledger) Ack() error {
+	return a.b.settle(a, true, a.Acknowledger.Ack)
+}
+
+// Reject implements the mq.Acknowledger interface.
+func (a *acknowledger) Reject(requeue bool) error {
+	return a.b.settle(a, false, func() error {
+		return a.Acknowledger.Reject(requeue)
+	})
+}
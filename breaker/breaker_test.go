@@ -0,0 +1,227 @@
+package breaker
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+	"github.com/go-mq/mq/v2/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	require := require.New(t)
+
+	var (
+		mu          sync.Mutex
+		transitions []State
+	)
+
+	b := New(Settings{
+		FailureRate: 0.5,
+		MinJobs:     4,
+		OpenTimeout: 50 * time.Millisecond,
+		OnStateChange: func(from, to State) {
+			mu.Lock()
+			defer mu.Unlock()
+			transitions = append(transitions, to)
+		},
+	})
+
+	b.Success()
+	b.Failure()
+	b.Failure()
+	require.Equal(Closed, b.State())
+
+	b.Success()
+	require.Equal(Open, b.State())
+
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(HalfOpen, b.State())
+
+	// a failed probe opens it again
+	b.Failure()
+	require.Equal(Open, b.State())
+
+	time.Sleep(60 * time.Millisecond)
+	b.Success()
+	require.Equal(Closed, b.State())
+
+	m := b.Metrics()
+	require.Equal(Closed, m.State)
+	require.EqualValues(3, m.Successes)
+	require.EqualValues(3, m.Failures)
+	require.EqualValues(2, m.Trips)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal([]State{Open, HalfOpen, Open, HalfOpen, Closed}, transitions)
+}
+
+func TestBreaker_Wrap(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.New().Queue("breaker")
+	require.NoError(err)
+
+	test.Publish(t, q, 0, 1, 2, 3)
+
+	const timeout = 100 * time.Millisecond
+	b := New(Settings{FailureRate: 1, MinJobs: 2, OpenTimeout: timeout})
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	iter = b.Wrap(iter)
+	defer iter.Close()
+
+	first, err := iter.Next()
+	require.NoError(err)
+	inFlight, err := iter.Next()
+	require.NoError(err)
+
+	require.NoError(first.Reject(true))
+	j, err := iter.Next()
+	require.NoError(err)
+	require.NoError(j.Reject(true))
+	require.Equal(Open, b.State())
+
+	// the job in flight was requeued when the breaker opened, so it is not
+	// buried
+	require.NoError(inFlight.Reject(false))
+	stats, err := q.(mq.Inspector).Stats()
+	require.NoError(err)
+	require.Equal(4, stats.Ready)
+
+	start := time.Now()
+	j, err = iter.Next()
+	require.NoError(err)
+	require.True(time.Since(start) >= timeout/2)
+	require.Equal(HalfOpen, b.State())
+	require.NoError(j.Ack())
+	require.Equal(Closed, b.State())
+
+	m := b.Metrics()
+	require.EqualValues(1, m.Requeued)
+	require.EqualValues(2, m.Failures)
+
+	var buried int
+	require.NoError(q.RepublishBuried(func(*mq.Job) bool {
+		buried++
+		return false
+	}))
+	require.Zero(buried)
+}
+
+func TestBreaker_stuckProbe(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.New().Queue("breaker")
+	require.NoError(err)
+
+	test.Publish(t, q, 0, 1)
+
+	const timeout = 50 * time.Millisecond
+	b := New(Settings{FailureRate: 1, MinJobs: 1, OpenTimeout: timeout})
+	b.Failure()
+	require.Equal(Open, b.State())
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	iter = b.Wrap(iter)
+	defer iter.Close()
+
+	probe, err := iter.Next()
+	require.NoError(err)
+	require.Equal(HalfOpen, b.State())
+
+	// the probe never finishes, so another job is let through in its place
+	// without opening the breaker again
+	start := time.Now()
+	j, err := iter.Next()
+	require.NoError(err)
+	require.True(time.Since(start) >= timeout/2)
+	require.NotEqual(probe.ID, j.ID)
+	require.Equal(HalfOpen, b.State())
+
+	require.NoError(j.Ack())
+	require.Equal(Closed, b.State())
+	require.NoError(probe.Ack())
+
+	m := b.Metrics()
+	require.EqualValues(1, m.Trips)
+	require.EqualValues(0, m.Requeued)
+	require.EqualValues(2, m.Successes)
+}
+
+func TestBreaker_idleHalfOpen(t *testing.T) {
+	require := require.New(t)
+
+	const timeout = 20 * time.Millisecond
+	b := New(Settings{FailureRate: 1, MinJobs: 1, OpenTimeout: timeout})
+	b.Failure()
+
+	// without any probe delivered, the breaker stays half-open
+	time.Sleep(3 * timeout)
+	require.Equal(HalfOpen, b.State())
+	time.Sleep(3 * timeout)
+	require.Equal(HalfOpen, b.Metrics().State)
+	require.EqualValues(1, b.Metrics().Trips)
+}
+
+type failingAcknowledger struct {
+	mq.Acknowledger
+}
+
+func (failingAcknowledger) Ack() error {
+	return fmt.Errorf("ack failed")
+}
+
+type failingIter struct {
+	mq.JobIter
+}
+
+func (i failingIter) Next() (*mq.Job, error) {
+	j, err := i.JobIter.Next()
+	if err != nil || j == nil {
+		return j, err
+	}
+
+	j.Acknowledger = failingAcknowledger{j.Acknowledger}
+	return j, nil
+}
+
+func TestBreaker_failedAck(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.New().Queue("breaker")
+	require.NoError(err)
+
+	test.Publish(t, q, 0, 1)
+
+	const timeout = 20 * time.Millisecond
+	b := New(Settings{FailureRate: 1, MinJobs: 1, OpenTimeout: timeout})
+	b.Failure()
+	time.Sleep(2 * timeout)
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	iter = b.Wrap(failingIter{iter})
+	defer iter.Close()
+
+	// the acknowledgement failed, so the probe neither counts as a success
+	// nor keeps its slot
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Error(j.Ack())
+	require.Equal(HalfOpen, b.State())
+	require.EqualValues(0, b.Metrics().Successes)
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.NoError(j.Reject(true))
+	require.Equal(Open, b.State())
+}
@@ -0,0 +1,63 @@
+package mq
+
+import (
+	"context"
+	"io"
+)
+
+// Channel returns a channel delivering the jobs returned by the given JobIter
+// and a channel delivering at most one error. Jobs are fetched one at a time,
+// so no more jobs than the window advertised to Queue.Consume are ever taken
+// from the iterator, and the next job is not requested until the previous one
+// has been received.
+//
+// Cancelling the context closes the iterator and stops the delivery. A job
+// taken from the iterator that could not be delivered is put back in the
+// queue with Reject(true). Both channels are closed once the iterator is
+// exhausted, closed or fails.
+func Channel(ctx context.Context, iter JobIter) (<-chan *Job, <-chan error) {
+	jobs := make(chan *Job)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			iter.Close()
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer close(errs)
+		defer close(jobs)
+		defer close(done)
+
+		for {
+			j, err := iter.Next()
+			if err != nil {
+				if err != io.EOF && !ErrAlreadyClosed.Is(err) {
+					errs <- err
+				}
+				return
+			}
+
+			if j == nil {
+				continue
+			}
+
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				// closing the iterator could have already requeued it
+				err := j.Reject(true)
+				if err != nil && !ErrLeaseExpired.Is(err) {
+					errs <- err
+				}
+				return
+			}
+		}
+	}()
+
+	return jobs, errs
+}
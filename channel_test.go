@@ -0,0 +1,124 @@
+package mq_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannel(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.New().Queue("channel")
+	require.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		j := mq.NewJob()
+		require.NoError(j.Encode(i))
+		require.NoError(q.Publish(j))
+	}
+
+	iter, err := q.Consume(1)
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs, errs := mq.Channel(ctx, iter)
+	for i := 0; i < 3; i++ {
+		j := <-jobs
+		require.NotNil(j)
+
+		var payload int
+		require.NoError(j.Decode(&payload))
+		require.Equal(i, payload)
+		require.NoError(j.Ack())
+	}
+
+	cancel()
+	assertClosed(t, jobs, errs)
+}
+
+func TestChannel_cancel_requeue(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.New().Queue("channel-requeue")
+	require.NoError(err)
+
+	j := mq.NewJob()
+	require.NoError(j.Encode("hello"))
+	require.NoError(q.Publish(j))
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, errs := mq.Channel(ctx, iter)
+
+	// give the goroutine time to take the job from the iterator
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err, ok := <-errs:
+		require.False(ok, "unexpected error: %v", err)
+	case <-time.After(2 * time.Second):
+		require.FailNow("channels were not closed")
+	}
+
+	iter, err = q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err = iter.Next()
+	require.NoError(err)
+
+	var payload string
+	require.NoError(j.Decode(&payload))
+	require.Equal("hello", payload)
+}
+
+func TestChannel_window_full(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.New().Queue("channel-window")
+	require.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		j := mq.NewJob()
+		require.NoError(j.Encode(i))
+		require.NoError(q.Publish(j))
+	}
+
+	iter, err := q.Consume(1)
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs, errs := mq.Channel(ctx, iter)
+
+	// the job is never acked, so the next one can't be taken
+	require.NotNil(<-jobs)
+	cancel()
+
+	assertClosed(t, jobs, errs)
+}
+
+func assertClosed(t *testing.T, jobs <-chan *mq.Job, errs <-chan error) {
+	t.Helper()
+
+	select {
+	case j, ok := <-jobs:
+		assert.False(t, ok, "unexpected job: %v", j)
+	case <-time.After(2 * time.Second):
+		assert.FailNow(t, "jobs channel was not closed")
+	}
+
+	err, ok := <-errs
+	assert.False(t, ok, "unexpected error: %v", err)
+}
@@ -28,6 +28,46 @@ var (
 	// ErrTxNotSupported is the error returned when the transaction receives a
 	// callback does not know how to handle.
 	ErrTxNotSupported = errors.NewKind("transactions not supported")
+	// ErrLeaseExpired is the error returned when acknowledging a job whose
+	// lease expired and that was put back in the queue.
+	ErrLeaseExpired = errors.NewKind("job lease expired")
+	// ErrInvalidDeadLetter is the error returned when a queue can't be used
+	// as dead-letter queue.
+	ErrInvalidDeadLetter = errors.NewKind("invalid dead-letter queue: %s")
+	// ErrUniqueConflict is the error returned when a job is published while
+	// another job with the same unique key is pending or running.
+	ErrUniqueConflict = errors.NewKind("a job with unique key %s is already pending or running")
+	// ErrCancelNotSupported is the error returned when a queue can't cancel
+	// jobs.
+	ErrCancelNotSupported = errors.NewKind("canceling jobs not supported")
+	// ErrDeleteQueueNotSupported is the error returned when a broker can't
+	// delete its queues.
+	ErrDeleteQueueNotSupported = errors.NewKind("deleting queues not supported")
+	// ErrInvalidHeartbeat is the error returned by Heartbeat when the
+	// interval of the heartbeats is not positive.
+	ErrInvalidHeartbeat = errors.NewKind("invalid heartbeat interval: %s")
+)
+
+// UniquePolicy defines what happens when a job is published while another
+// job with the same unique key is pending or running, see Job.UniqueKey.
+type UniquePolicy int
+
+const (
+	// UniqueReject rejects the published job with ErrUniqueConflict.
+	UniqueReject UniquePolicy = iota
+	// UniqueReplace replaces the pending job, ready or delayed, with the
+	// published one. The published job is rejected with ErrUniqueConflict
+	// if the other job is already running.
+	UniqueReplace
+)
+
+const (
+	// DeadLetterRejected is the DeadLetterReason of the jobs rejected without
+	// requeue.
+	DeadLetterRejected = "rejected"
+	// DeadLetterExpired is the DeadLetterReason of the jobs whose lease
+	// expired after being delivered too many times.
+	DeadLetterExpired = "expired"
 )
 
 // Broker represents a message broker.
@@ -79,6 +119,105 @@ type Queue interface {
 	RepublishBuried(conditions ...RepublishConditionFunc) error
 }
 
+// DeadLetterPolicy defines which jobs of a queue are dead-lettered and where.
+type DeadLetterPolicy struct {
+	// Queue is the name of the dead-letter queue, a regular queue that can be
+	// shared by many source queues. Use "" to disable dead-lettering.
+	Queue string
+	// MaxDeliveries is the number of deliveries after which a job whose
+	// lease expired is dead-lettered instead of requeued. Use 0 to always
+	// requeue them.
+	MaxDeliveries int32
+}
+
+// DeadLetterer is implemented by the queues that can route their failed jobs
+// to a dead-letter queue instead of burying them.
+type DeadLetterer interface {
+	// SetDeadLetter sets the DeadLetterPolicy of the queue. Jobs rejected
+	// without requeue, or expired after DeadLetterPolicy.MaxDeliveries, are
+	// published to the dead-letter queue with their DeadLetterOrigin and
+	// DeadLetterReason set, and their deliveries counted from zero.
+	SetDeadLetter(DeadLetterPolicy) error
+}
+
+// QueueStats holds the number of jobs of a queue in every state.
+type QueueStats struct {
+	// Ready is the number of jobs waiting to be delivered.
+	Ready int
+	// Delayed is the number of jobs published with a delay not yet ready.
+	Delayed int
+	// InFlight is the number of delivered jobs not acknowledged yet.
+	InFlight int
+	// Buried is the number of jobs in the buried queue.
+	Buried int
+}
+
+// Inspector is implemented by the queues able to report their stats.
+type Inspector interface {
+	// Stats returns the current stats of the queue.
+	Stats() (QueueStats, error)
+}
+
+// Deduplicator is implemented by the queues able to detect duplicated
+// publications of a job, see Job.DedupKey.
+type Deduplicator interface {
+	// PublishDedup publishes the given Job to the queue, unless a job with
+	// the same dedup key was already published within the dedup window of
+	// the queue. Duplicates are accepted but dropped, and reported by
+	// returning true.
+	PublishDedup(*Job) (duplicate bool, err error)
+}
+
+// PublishDedup publishes the Job to the Queue, reporting whether it was a
+// duplicate if the Queue implements Deduplicator. Otherwise, it just
+// publishes the job and returns false.
+func PublishDedup(q Queue, j *Job) (bool, error) {
+	if d, ok := q.(Deduplicator); ok {
+		return d.PublishDedup(j)
+	}
+
+	return false, q.Publish(j)
+}
+
+// Canceler is implemented by the queues able to cancel the jobs published to
+// them.
+type Canceler interface {
+	// Cancel removes the ready, delayed or buried job with the given ID from
+	// the queue. A job being processed is discarded once it's acknowledged
+	// or rejected, and it's not delivered again if its lease expires. It
+	// returns false if there is no job with that ID.
+	Cancel(id string) (bool, error)
+}
+
+// Cancel cancels the job with the given ID, see Canceler. It returns
+// ErrCancelNotSupported if the Queue does not implement Canceler.
+func Cancel(q Queue, id string) (bool, error) {
+	if c, ok := q.(Canceler); ok {
+		return c.Cancel(id)
+	}
+
+	return false, ErrCancelNotSupported.New()
+}
+
+// QueueDeleter is implemented by the brokers able to delete their queues.
+type QueueDeleter interface {
+	// DeleteQueue deletes the queue with the given name and its jobs, it
+	// does nothing if the queue does not exist. The queue is created again
+	// the next time it's used.
+	DeleteQueue(name string) error
+}
+
+// DeleteQueue deletes the queue with the given name, see QueueDeleter. It
+// returns ErrDeleteQueueNotSupported if the Broker does not implement
+// QueueDeleter.
+func DeleteQueue(b Broker, name string) error {
+	if d, ok := b.(QueueDeleter); ok {
+		return d.DeleteQueue(name)
+	}
+
+	return ErrDeleteQueueNotSupported.New()
+}
+
 // JobIter represents an iterator over a set of Jobs.
 type JobIter interface {
 	// Next returns the next Job in the iterator. It should block until
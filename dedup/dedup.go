@@ -0,0 +1,195 @@
+// Package dedup implements the deduplication of published jobs for any
+// backend, as a decorator of mq.Broker keeping the dedup keys of the
+// published jobs in a pluggable Store.
+package dedup
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+)
+
+// Store keeps the dedup keys seen within a window of time.
+type Store interface {
+	// Add records the key for the given window of time. It returns false if
+	// the key was already recorded and its window has not passed yet.
+	Add(key string, window time.Duration) (bool, error)
+	// Remove forgets the key.
+	Remove(key string) error
+}
+
+// NewMemoryStore returns a Store keeping the keys in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{keys: make(map[string]time.Time)}
+}
+
+type memoryStore struct {
+	mu   sync.Mutex
+	keys map[string]time.Time
+	// gc is the next time expired keys will be removed.
+	gc time.Time
+}
+
+// Add implements the Store interface.
+func (s *memoryStore) Add(key string, window time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.After(s.gc) {
+		for k, expiration := range s.keys {
+			if !now.Before(expiration) {
+				delete(s.keys, k)
+			}
+		}
+
+		s.gc = now.Add(window)
+	}
+
+	if expiration, ok := s.keys[key]; ok && now.Before(expiration) {
+		return false, nil
+	}
+
+	s.keys[key] = now.Add(window)
+	return true, nil
+}
+
+// Remove implements the Store interface.
+func (s *memoryStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+	return nil
+}
+
+// New returns a Broker whose queues drop the jobs published with the same
+// dedup key as a job published to the same queue within the window. The
+// returned queues implement mq.Deduplicator.
+func New(b mq.Broker, s Store, window time.Duration) mq.Broker {
+	return mq.WrapBroker(b, &broker{Broker: b, s: s, window: window})
+}
+
+type broker struct {
+	mq.Broker
+	s      Store
+	window time.Duration
+}
+
+// Queue implements the mq.Broker interface.
+func (b *broker) Queue(name string) (mq.Queue, error) {
+	q, err := b.Broker.Queue(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return mq.WrapQueue(q, &queue{Queue: q, name: name, b: b}), nil
+}
+
+type queue struct {
+	mq.Queue
+	name string
+	b    *broker
+}
+
+// Publish implements the mq.Queue interface.
+func (q *queue) Publish(j *mq.Job) error {
+	_, err := q.PublishDedup(j)
+	return err
+}
+
+// PublishDedup implements the mq.Deduplicator interface.
+func (q *queue) PublishDedup(j *mq.Job) (bool, error) {
+	return q.publish(j, q.Queue.Publish)
+}
+
+// PublishDelayed implements the mq.Queue interface.
+func (q *queue) PublishDelayed(j *mq.Job, delay time.Duration) error {
+	_, err := q.publish(j, func(j *mq.Job) error {
+		return q.Queue.PublishDelayed(j, delay)
+	})
+
+	return err
+}
+
+func (q *queue) publish(j *mq.Job, publish func(*mq.Job) error) (bool, error) {
+	if j == nil || j.Size() == 0 {
+		return false, mq.ErrEmptyJob.New()
+	}
+
+	key := q.key(j)
+	added, err := q.b.s.Add(key, q.b.window)
+	if err != nil {
+		return false, err
+	}
+
+	if !added {
+		return true, nil
+	}
+
+	if err := publish(j); err != nil {
+		q.b.s.Remove(key)
+		return false, err
+	}
+
+	return false, nil
+}
+
+// Transaction implements the mq.Queue interface. The dedup keys of the jobs
+// published in a failed transaction are forgotten.
+func (q *queue) Transaction(txcb mq.TxCallback) error {
+	var keys []string
+	err := q.Queue.Transaction(func(tx mq.Queue) error {
+		txQ := &txQueue{queue: &queue{Queue: tx, name: q.name, b: q.b}}
+		err := txcb(mq.WrapQueue(tx, txQ))
+		keys = txQ.keys
+		return err
+	})
+
+	if err != nil {
+		for _, key := range keys {
+			q.b.s.Remove(key)
+		}
+	}
+
+	return err
+}
+
+func (q *queue) key(j *mq.Job) string {
+	return q.name + "/" + j.DeduplicationKey()
+}
+
+// txQueue records the dedup keys of the jobs published in a transaction.
+type txQueue struct {
+	*queue
+	keys []string
+}
+
+// PublishDedup implements the mq.Deduplicator interface.
+func (q *txQueue) PublishDedup(j *mq.Job) (bool, error) {
+	duplicate, err := q.queue.PublishDedup(j)
+	if err == nil && !duplicate {
+		q.keys = append(q.keys, q.key(j))
+	}
+
+	return duplicate, err
+}
+
+// Publish implements the mq.Queue interface.
+func (q *txQueue) Publish(j *mq.Job) error {
+	_, err := q.PublishDedup(j)
+	return err
+}
+
+// PublishDelayed implements the mq.Queue interface.
+func (q *txQueue) PublishDelayed(j *mq.Job, delay time.Duration) error {
+	duplicate, err := q.publish(j, func(j *mq.Job) error {
+		return q.queue.Queue.PublishDelayed(j, delay)
+	})
+
+	if err == nil && !duplicate {
+		q.keys = append(q.keys, q.key(j))
+	}
+
+	return err
+}
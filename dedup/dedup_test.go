@@ -0,0 +1,119 @@
+package dedup
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue_PublishDedup(t *testing.T) {
+	require := require.New(t)
+
+	b := New(memory.NewFinite(true), NewMemoryStore(), 50*time.Millisecond)
+	q, err := b.Queue("dedup")
+	require.NoError(err)
+
+	other, err := b.Queue("other")
+	require.NoError(err)
+
+	j := newJob(t, "")
+	duplicate, err := mq.PublishDedup(q, j)
+	require.NoError(err)
+	require.False(duplicate)
+
+	duplicate, err = mq.PublishDedup(q, j)
+	require.NoError(err)
+	require.True(duplicate)
+	require.NoError(q.Publish(j))
+
+	// the keys are tracked per queue
+	duplicate, err = mq.PublishDedup(other, j)
+	require.NoError(err)
+	require.False(duplicate)
+
+	withKey := newJob(t, "same-key")
+	require.NoError(q.Publish(withKey))
+	require.NoError(q.Publish(newJob(t, "same-key")))
+
+	time.Sleep(60 * time.Millisecond)
+	duplicate, err = mq.PublishDedup(q, j)
+	require.NoError(err)
+	require.False(duplicate)
+
+	require.Equal(3, count(t, q))
+}
+
+func TestQueue_Transaction(t *testing.T) {
+	require := require.New(t)
+
+	b := New(memory.NewFinite(true), NewMemoryStore(), time.Minute)
+	q, err := b.Queue("tx")
+	require.NoError(err)
+
+	j := newJob(t, "")
+	err = q.Transaction(func(tx mq.Queue) error {
+		require.NoError(tx.Publish(j))
+		return errors.New("rollback")
+	})
+	require.Error(err)
+
+	// the key of the rolled back job was forgotten
+	require.NoError(q.Transaction(func(tx mq.Queue) error {
+		duplicate, err := mq.PublishDedup(tx, j)
+		require.False(duplicate)
+		return err
+	}))
+
+	duplicate, err := mq.PublishDedup(q, j)
+	require.NoError(err)
+	require.True(duplicate)
+
+	require.Equal(1, count(t, q))
+}
+
+func newJob(t *testing.T, key string) *mq.Job {
+	j := mq.NewJob()
+	j.DedupKey = key
+	require.NoError(t, j.Encode(key))
+	return j
+}
+
+func count(t *testing.T, q mq.Queue) int {
+	iter, err := q.Consume(0)
+	require.NoError(t, err)
+
+	var n int
+	for {
+		j, err := iter.Next()
+		if err == io.EOF {
+			return n
+		}
+
+		require.NoError(t, err)
+		require.NoError(t, j.Ack())
+		n++
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	require := require.New(t)
+
+	b := New(memory.New(), NewMemoryStore(), time.Minute)
+	require.Implements((*mq.Observable)(nil), b)
+	require.Implements((*mq.QueueDeleter)(nil), b)
+	require.Implements((*mq.TopicBroker)(nil), b)
+	require.Implements((*mq.LoggerSetter)(nil), b)
+
+	q, err := b.Queue("dedup")
+	require.NoError(err)
+	require.Implements((*mq.Canceler)(nil), q)
+	require.Implements((*mq.Deduplicator)(nil), q)
+	require.Implements((*mq.DeadLetterer)(nil), q)
+	require.Implements((*mq.Inspector)(nil), q)
+}
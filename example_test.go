@@ -8,7 +8,7 @@ import (
 	_ "github.com/go-mq/mq/v2/memory"
 )
 
-func ExampleMemoryQueue() {
+func Example_memoryQueue() {
 	b, err := mq.NewBroker("memory://")
 	if err != nil {
 		log.Fatal(err)
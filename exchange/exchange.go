@@ -0,0 +1,317 @@
+// Package exchange implements exchange-style routing of jobs to queues,
+// following the AMQP model: jobs are published to an exchange with a routing
+// key and delivered to every queue bound to it with a matching binding.
+//
+// Brokers with native exchanges implement the Declarer interface. For any
+// other Broker, the routing is emulated in-process on top of its queues, and
+// the emulated exchanges are kept by a Registry.
+package exchange
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/go-mq/mq/v2"
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+var (
+	// ErrKindMismatch is the error returned when an exchange is declared
+	// again with a different kind.
+	ErrKindMismatch = errors.NewKind("exchange %s already declared with a different kind")
+	// ErrInvalidBinding is the error returned when a binding is not valid for
+	// the kind of the exchange.
+	ErrInvalidBinding = errors.NewKind("invalid binding: %s")
+)
+
+// RoutingKeyHeader is the header holding the routing key a job was published
+// with.
+const RoutingKeyHeader = "routing-key"
+
+// Kind is the kind of an exchange, which defines how jobs are matched against
+// the bindings.
+type Kind int
+
+const (
+	// Direct exchanges route the jobs to the bindings whose Pattern is equal
+	// to the routing key.
+	Direct Kind = iota
+	// Fanout exchanges route the jobs to all the bindings.
+	Fanout
+	// Topic exchanges route the jobs to the bindings whose Pattern matches
+	// the routing key. Patterns and keys are lists of words separated by
+	// dots, where "*" matches exactly one word and "#" matches zero or more
+	// words, such as "orders.*.created" or "orders.#".
+	Topic
+	// Headers exchanges route the jobs to the bindings whose Headers match
+	// the headers of the job.
+	Headers
+)
+
+// Binding binds a queue to an exchange.
+type Binding struct {
+	// Queue is the name of the bound queue.
+	Queue string
+	// Pattern is the binding key the routing keys are matched against, used
+	// by Direct and Topic exchanges.
+	Pattern string
+	// Headers are the headers the job headers are matched against, used by
+	// Headers exchanges.
+	Headers map[string]string
+	// MatchAll requires all the Headers to match, instead of any of them.
+	MatchAll bool
+}
+
+// Exchange routes the jobs published to it to the bound queues.
+type Exchange interface {
+	// Bind binds a queue to the exchange.
+	Bind(Binding) error
+	// Unbind removes a binding from the exchange.
+	Unbind(Binding) error
+	// Publish publishes a copy of the job, with the RoutingKeyHeader set, to
+	// every queue with a matching binding. Jobs not matching any binding are
+	// dropped.
+	Publish(routingKey string, j *mq.Job) error
+}
+
+// Declarer is implemented by the Brokers with native exchanges.
+type Declarer interface {
+	// Exchange returns the exchange with the given name, declaring it if it
+	// does not exist.
+	Exchange(name string, kind Kind) (Exchange, error)
+}
+
+// Registry declares the exchanges of a Broker. If the Broker does not
+// implement Declarer, the exchanges are emulated in-process and shared by
+// every call to Exchange of the same Registry with the same name.
+type Registry struct {
+	b mq.Broker
+
+	mu       sync.Mutex
+	declared map[string]*exchange
+}
+
+// NewRegistry returns a new Registry declaring the exchanges of the given
+// Broker.
+func NewRegistry(b mq.Broker) *Registry {
+	return &Registry{b: b, declared: make(map[string]*exchange)}
+}
+
+// Exchange implements the Declarer interface. It returns ErrKindMismatch if
+// the exchange was already declared with a different kind.
+func (r *Registry) Exchange(name string, kind Kind) (Exchange, error) {
+	if d, ok := r.b.(Declarer); ok {
+		return d.Exchange(name, kind)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.declared[name]; ok {
+		if e.kind != kind {
+			return nil, ErrKindMismatch.New(name)
+		}
+
+		return e, nil
+	}
+
+	e := &exchange{b: r.b, kind: kind}
+	r.declared[name] = e
+	return e, nil
+}
+
+// Delete removes the emulated exchange with the given name and its bindings,
+// the next call to Exchange declares it again. It does nothing if the Broker
+// implements Declarer.
+func (r *Registry) Delete(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.declared, name)
+}
+
+// New returns a new unnamed exchange of the given kind emulated in-process on
+// top of the queues of the Broker.
+func New(b mq.Broker, kind Kind) Exchange {
+	return &exchange{b: b, kind: kind}
+}
+
+type exchange struct {
+	b    mq.Broker
+	kind Kind
+
+	mu       sync.RWMutex
+	bindings []Binding
+}
+
+// Bind implements the Exchange interface.
+func (e *exchange) Bind(b Binding) error {
+	if b.Queue == "" {
+		return ErrInvalidBinding.New("empty queue name")
+	}
+
+	if e.kind == Topic && !validPattern(b.Pattern) {
+		return ErrInvalidBinding.New(b.Pattern)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, bound := range e.bindings {
+		if equal(bound, b) {
+			return nil
+		}
+	}
+
+	e.bindings = append(e.bindings, b)
+	return nil
+}
+
+// Unbind implements the Exchange interface.
+func (e *exchange) Unbind(b Binding) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, bound := range e.bindings {
+		if equal(bound, b) {
+			e.bindings = append(e.bindings[:i], e.bindings[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// Publish implements the Exchange interface.
+func (e *exchange) Publish(routingKey string, j *mq.Job) error {
+	if j == nil || j.Size() == 0 {
+		return mq.ErrEmptyJob.New()
+	}
+
+	for _, name := range e.route(routingKey, j) {
+		q, err := e.b.Queue(name)
+		if err != nil {
+			return err
+		}
+
+		c := *j
+		c.Acknowledger = nil
+		c.Headers = make(map[string]string, len(j.Headers)+1)
+		for k, v := range j.Headers {
+			c.Headers[k] = v
+		}
+		c.Headers[RoutingKeyHeader] = routingKey
+
+		if err := q.Publish(&c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// route returns the names of the queues the job must be published to.
+func (e *exchange) route(routingKey string, j *mq.Job) []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var queues []string
+	seen := make(map[string]bool)
+	for _, b := range e.bindings {
+		if seen[b.Queue] || !e.match(b, routingKey, j) {
+			continue
+		}
+
+		seen[b.Queue] = true
+		queues = append(queues, b.Queue)
+	}
+
+	return queues
+}
+
+func (e *exchange) match(b Binding, routingKey string, j *mq.Job) bool {
+	switch e.kind {
+	case Direct:
+		return b.Pattern == routingKey
+	case Fanout:
+		return true
+	case Topic:
+		return MatchTopic(b.Pattern, routingKey)
+	case Headers:
+		return MatchHeaders(b.Headers, j.Headers, b.MatchAll)
+	default:
+		return false
+	}
+}
+
+// MatchTopic returns true if the routing key matches the pattern of a Topic
+// binding.
+func MatchTopic(pattern, routingKey string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && pattern[0] == key[0] &&
+			matchWords(pattern[1:], key[1:])
+	}
+}
+
+func validPattern(pattern string) bool {
+	for _, w := range strings.Split(pattern, ".") {
+		if w == "" || (len(w) > 1 && strings.ContainsAny(w, "*#")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchHeaders returns true if the headers match the headers of a Headers
+// binding: all of them if all is true, or any of them otherwise. An empty
+// binding matches any headers.
+func MatchHeaders(binding, headers map[string]string, all bool) bool {
+	if len(binding) == 0 {
+		return true
+	}
+
+	for k, v := range binding {
+		hv, ok := headers[k]
+		matched := ok && hv == v
+		if matched && !all {
+			return true
+		}
+
+		if !matched && all {
+			return false
+		}
+	}
+
+	return all
+}
+
+func equal(a, b Binding) bool {
+	if a.Queue != b.Queue || a.Pattern != b.Pattern ||
+		a.MatchAll != b.MatchAll || len(a.Headers) != len(b.Headers) {
+		return false
+	}
+
+	for k, v := range a.Headers {
+		if bv, ok := b.Headers[k]; !ok || bv != v {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,147 @@
+package exchange
+
+import (
+	"io"
+	"testing"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchTopic(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"orders.eu.created", "orders.eu.created", true},
+		{"orders.eu.created", "orders.us.created", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.west.created", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.eu.created", true},
+		{"#.created", "orders.eu.created", true},
+		{"orders.#.created", "orders.created", true},
+		{"orders.#.created", "orders.eu.deleted", false},
+		{"#", "anything.at.all", true},
+		{"*", "orders.eu", false},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.match, MatchTopic(tc.pattern, tc.key),
+			"pattern %q, key %q", tc.pattern, tc.key)
+	}
+}
+
+func TestMatchHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	binding := map[string]string{"region": "eu", "type": "created"}
+	assert.True(MatchHeaders(binding, map[string]string{"region": "eu"}, false))
+	assert.False(MatchHeaders(binding, map[string]string{"region": "eu"}, true))
+	assert.True(MatchHeaders(binding, map[string]string{
+		"region": "eu", "type": "created", "other": "value",
+	}, true))
+	assert.False(MatchHeaders(binding, nil, false))
+	assert.True(MatchHeaders(nil, nil, true))
+}
+
+func TestExchange_Topic(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	r := NewRegistry(b)
+	e, err := r.Exchange("orders", Topic)
+	require.NoError(err)
+
+	require.NoError(e.Bind(Binding{Queue: "created", Pattern: "orders.*.created"}))
+	require.NoError(e.Bind(Binding{Queue: "all", Pattern: "orders.#"}))
+	require.NoError(e.Bind(Binding{Queue: "all", Pattern: "#.created"}))
+	require.True(ErrInvalidBinding.Is(e.Bind(Binding{Queue: "bad", Pattern: "orders.eu*"})))
+
+	_, err = r.Exchange("orders", Direct)
+	require.True(ErrKindMismatch.Is(err))
+
+	same, err := r.Exchange("orders", Topic)
+	require.NoError(err)
+	require.True(e == same)
+
+	// other registries have their own exchanges
+	other, err := NewRegistry(b).Exchange("orders", Direct)
+	require.NoError(err)
+	require.False(e == other)
+
+	publish(t, e, "orders.eu.created", nil)
+	publish(t, e, "orders.us.deleted", nil)
+	publish(t, e, "users.created", nil)
+
+	require.Equal([]string{"orders.eu.created"}, routingKeys(t, b, "created"))
+	require.Equal([]string{
+		"orders.eu.created", "orders.us.deleted", "users.created",
+	}, routingKeys(t, b, "all"))
+
+	require.NoError(e.Unbind(Binding{Queue: "created", Pattern: "orders.*.created"}))
+	publish(t, e, "orders.eu.created", nil)
+	require.Empty(routingKeys(t, b, "created"))
+
+	r.Delete("orders")
+	declared, err := r.Exchange("orders", Direct)
+	require.NoError(err)
+	require.False(e == declared)
+}
+
+func TestExchange_Headers(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	e := New(b, Headers)
+
+	require.NoError(e.Bind(Binding{
+		Queue:    "eu-created",
+		Headers:  map[string]string{"region": "eu", "type": "created"},
+		MatchAll: true,
+	}))
+	require.NoError(e.Bind(Binding{
+		Queue:   "eu",
+		Headers: map[string]string{"region": "eu"},
+	}))
+
+	publish(t, e, "a", map[string]string{"region": "eu", "type": "created"})
+	publish(t, e, "b", map[string]string{"region": "eu", "type": "deleted"})
+	publish(t, e, "c", map[string]string{"region": "us", "type": "created"})
+
+	require.Equal([]string{"a"}, routingKeys(t, b, "eu-created"))
+	require.Equal([]string{"a", "b"}, routingKeys(t, b, "eu"))
+}
+
+func publish(t *testing.T, e Exchange, key string, headers map[string]string) {
+	j := mq.NewJob()
+	j.Headers = headers
+	require.NoError(t, j.Encode(key))
+	require.NoError(t, e.Publish(key, j))
+}
+
+func routingKeys(t *testing.T, b mq.Broker, queue string) []string {
+	q, err := b.Queue(queue)
+	require.NoError(t, err)
+
+	iter, err := q.Consume(0)
+	require.NoError(t, err)
+
+	var keys []string
+	for {
+		j, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+		require.NoError(t, j.Ack())
+		keys = append(keys, j.Headers[RoutingKeyHeader])
+	}
+
+	return keys
+}
@@ -0,0 +1,66 @@
+package mq
+
+import (
+	"context"
+	"time"
+)
+
+// Heartbeat calls fn while extending the lease of the job by the given
+// extension on every interval, so long running jobs are not delivered again
+// while they are being processed. If the lease can't be extended anymore,
+// the context given to fn is cancelled. Jobs whose Acknowledger does not
+// implement Extender are processed without heartbeats.
+//
+// It returns the error returned by fn or, if fn succeeded, the error that
+// stopped the heartbeats. If the interval is not positive, fn is not called
+// and ErrInvalidHeartbeat is returned.
+func Heartbeat(
+	ctx context.Context,
+	j *Job,
+	interval, extension time.Duration,
+	fn func(context.Context) error,
+) error {
+	if interval <= 0 {
+		return ErrInvalidHeartbeat.New(interval)
+	}
+
+	if !j.CanExtend() {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := j.Extend(extension); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := fn(ctx); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
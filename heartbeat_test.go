@@ -0,0 +1,96 @@
+package mq_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeat(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.NewFinite(true).Queue("heartbeat")
+	require.NoError(err)
+
+	j := mq.NewJob()
+	require.NoError(j.Encode(true))
+	require.NoError(q.Publish(j))
+
+	const visibility = 50 * time.Millisecond
+	iter, err := q.(*memory.Queue).ConsumeWithVisibility(0, visibility)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.True(j.CanExtend())
+
+	err = mq.Heartbeat(context.Background(), j, visibility/5, visibility,
+		func(ctx context.Context) error {
+			time.Sleep(4 * visibility)
+			return ctx.Err()
+		})
+	require.NoError(err)
+	require.NoError(j.Ack())
+}
+
+func TestHeartbeat_lease_lost(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.New().Queue("heartbeat-lost")
+	require.NoError(err)
+
+	j := mq.NewJob()
+	require.NoError(j.Encode(true))
+	require.NoError(q.Publish(j))
+
+	iter, err := q.(*memory.Queue).ConsumeWithVisibility(0, time.Minute)
+	require.NoError(err)
+
+	j, err = iter.Next()
+	require.NoError(err)
+
+	err = mq.Heartbeat(context.Background(), j, 10*time.Millisecond, time.Minute,
+		func(ctx context.Context) error {
+			// closing the iterator puts the job back in the queue
+			require.NoError(iter.Close())
+			<-ctx.Done()
+			return nil
+		})
+	require.True(mq.ErrLeaseExpired.Is(err))
+}
+
+func TestHeartbeat_not_supported(t *testing.T) {
+	require := require.New(t)
+
+	j := mq.NewJob()
+	require.False(j.CanExtend())
+	require.True(mq.ErrCantAck.Is(j.Extend(time.Second)))
+
+	var called bool
+	err := mq.Heartbeat(context.Background(), j, time.Millisecond, time.Second,
+		func(context.Context) error {
+			called = true
+			return nil
+		})
+	require.NoError(err)
+	require.True(called)
+}
+
+func TestHeartbeat_invalid_interval(t *testing.T) {
+	require := require.New(t)
+
+	var called bool
+	err := mq.Heartbeat(context.Background(), mq.NewJob(), 0, time.Second,
+		func(context.Context) error {
+			called = true
+			return nil
+		})
+	require.True(mq.ErrInvalidHeartbeat.Is(err))
+	require.False(called)
+}
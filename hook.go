@@ -0,0 +1,434 @@
+package mq
+
+import (
+	"sync"
+	"time"
+)
+
+// Transition is a step of the lifecycle of a job.
+type Transition int
+
+const (
+	// Published is fired when a job is published, delayed or not. Failed
+	// publications are fired too, with the error of the publication.
+	Published Transition = iota
+	// Delivered is fired when a job is returned by a JobIter.
+	Delivered
+	// Acked is fired when a job is acknowledged, only once per delivery.
+	Acked
+	// Rejected is fired when a job is rejected, and also when the job is put
+	// back in the queue because its lease expired or its JobIter was closed.
+	Rejected
+	// Buried is fired when a job is sent to the buried queue or to the
+	// dead-letter queue, after its Rejected event.
+	Buried
+	// Canceled is fired when a pending job is removed from its queue, either
+	// canceled, see Canceler, or replaced by a job with the same unique key.
+	// The canceled jobs being processed fire it once they are discarded,
+	// after their Rejected event, unless they are acknowledged.
+	Canceled
+)
+
+// String returns the name of the Transition.
+func (t Transition) String() string {
+	switch t {
+	case Published:
+		return "published"
+	case Delivered:
+		return "delivered"
+	case Acked:
+		return "acked"
+	case Rejected:
+		return "rejected"
+	case Buried:
+		return "buried"
+	case Canceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a transition of a job in a queue.
+type Event struct {
+	// Queue is the name of the queue.
+	Queue string
+	// Job is the job, nil when publishing a nil job. It must not be modified.
+	Job        *Job
+	Transition Transition
+	// Requeue tells whether a rejected job is put back in the queue.
+	Requeue bool
+	// Delay is the delay of a job published with PublishDelayed.
+	Delay time.Duration
+	// Err is the error of the operation, if it failed. The Rejected and
+	// Buried events of the jobs whose lease expired, or whose JobIter was
+	// closed, carry ErrLeaseExpired.
+	Err  error
+	Time time.Time
+}
+
+// Hook receives the events of the jobs. It is called synchronously, after
+// the operation causing the event, and the events of a queue are received in
+// the order they happened. When several operations of a queue run
+// concurrently, the events of one of them may be fired by another one, after
+// it returned. Use NewAsyncHook to handle the events in the background.
+type Hook interface {
+	OnEvent(Event)
+}
+
+// HookFunc is a function implementing the Hook interface.
+type HookFunc func(Event)
+
+// OnEvent implements the Hook interface.
+func (f HookFunc) OnEvent(e Event) {
+	f(e)
+}
+
+// Hooks is a Hook calling a different function for each transition. The nil
+// functions are skipped.
+type Hooks struct {
+	OnPublish func(Event)
+	OnDeliver func(Event)
+	OnAck     func(Event)
+	OnReject  func(Event)
+	OnBury    func(Event)
+	OnCancel  func(Event)
+}
+
+// OnEvent implements the Hook interface.
+func (h *Hooks) OnEvent(e Event) {
+	var fn func(Event)
+	switch e.Transition {
+	case Published:
+		fn = h.OnPublish
+	case Delivered:
+		fn = h.OnDeliver
+	case Acked:
+		fn = h.OnAck
+	case Rejected:
+		fn = h.OnReject
+	case Buried:
+		fn = h.OnBury
+	case Canceled:
+		fn = h.OnCancel
+	}
+
+	if fn != nil {
+		fn(e)
+	}
+}
+
+// Observable is implemented by the brokers firing the events of their jobs.
+type Observable interface {
+	AddHook(Hook)
+}
+
+// AddHook registers the Hook in the Broker. If the Broker does not implement
+// Observable, it is wrapped with WithHooks and the wrapper is returned, so the
+// returned Broker must be used from then on.
+func AddHook(b Broker, h Hook) Broker {
+	if o, ok := b.(Observable); ok {
+		o.AddHook(h)
+		return b
+	}
+
+	return WithHooks(b, h)
+}
+
+// HookSet is a concurrency safe list of hooks, to be used by the
+// implementations of Observable.
+type HookSet struct {
+	mu    sync.RWMutex
+	hooks []Hook
+}
+
+// AddHook implements the Observable interface.
+func (s *HookSet) AddHook(h Hook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, h)
+}
+
+// Empty returns true if there are no hooks.
+func (s *HookSet) Empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.hooks) == 0
+}
+
+// Fire calls the hooks with the given events, in order. The zero Time of the
+// events is set to the current time.
+func (s *HookSet) Fire(events ...Event) {
+	s.mu.RLock()
+	hooks := s.hooks
+	s.mu.RUnlock()
+
+	for _, e := range events {
+		if e.Time.IsZero() {
+			e.Time = time.Now()
+		}
+
+		for _, h := range hooks {
+			h.OnEvent(e)
+		}
+	}
+}
+
+// AsyncHook is a Hook handling the events in a background goroutine, in the
+// order they are fired. Firing an event blocks while the buffer is full.
+type AsyncHook struct {
+	h      Hook
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewAsyncHook returns an AsyncHook calling the given Hook, buffering up to
+// the given number of events.
+func NewAsyncHook(h Hook, buffer int) *AsyncHook {
+	a := &AsyncHook{
+		h:      h,
+		events: make(chan Event, buffer),
+		done:   make(chan struct{}),
+	}
+
+	go a.run()
+	return a
+}
+
+func (a *AsyncHook) run() {
+	defer close(a.done)
+	for e := range a.events {
+		a.h.OnEvent(e)
+	}
+}
+
+// OnEvent implements the Hook interface. It must not be called after Close.
+func (a *AsyncHook) OnEvent(e Event) {
+	a.events <- e
+}
+
+// Close waits until the buffered events are handled, and stops the
+// goroutine.
+func (a *AsyncHook) Close() error {
+	a.once.Do(func() { close(a.events) })
+	<-a.done
+	return nil
+}
+
+// WithHooks returns a Broker firing the events of the jobs of the given
+// Broker, for the brokers that don't implement Observable. The Buried events
+// are fired when the jobs are rejected without requeuing them.
+func WithHooks(b Broker, hooks ...Hook) Broker {
+	hb := &hookBroker{Broker: b}
+	for _, h := range hooks {
+		hb.AddHook(h)
+	}
+
+	return WrapBroker(b, hb)
+}
+
+type hookBroker struct {
+	Broker
+	hooks HookSet
+}
+
+// AddHook implements the Observable interface.
+func (b *hookBroker) AddHook(h Hook) {
+	b.hooks.AddHook(h)
+}
+
+// Queue implements the Broker interface.
+func (b *hookBroker) Queue(name string) (Queue, error) {
+	q, err := b.Broker.Queue(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return WrapQueue(q, &hookQueue{Queue: q, name: name, hooks: &b.hooks}), nil
+}
+
+type hookQueue struct {
+	Queue
+	name  string
+	hooks *HookSet
+}
+
+func (q *hookQueue) fire(j *Job, t Transition, err error) {
+	q.hooks.Fire(Event{Queue: q.name, Job: j, Transition: t, Err: err})
+}
+
+// Publish implements the Queue interface.
+func (q *hookQueue) Publish(j *Job) error {
+	err := q.Queue.Publish(j)
+	q.fire(j, Published, err)
+	return err
+}
+
+// PublishDedup implements the Deduplicator interface, the duplicates are not
+// fired as Published.
+func (q *hookQueue) PublishDedup(j *Job) (bool, error) {
+	duplicate, err := PublishDedup(q.Queue, j)
+	if !duplicate {
+		q.fire(j, Published, err)
+	}
+
+	return duplicate, err
+}
+
+// PublishDelayed implements the Queue interface.
+func (q *hookQueue) PublishDelayed(j *Job, delay time.Duration) error {
+	err := q.Queue.PublishDelayed(j, delay)
+	q.hooks.Fire(Event{
+		Queue:      q.name,
+		Job:        j,
+		Transition: Published,
+		Delay:      delay,
+		Err:        err,
+	})
+
+	return err
+}
+
+// Transaction implements the Queue interface, the events of the jobs
+// published in the transaction are fired once it is committed.
+func (q *hookQueue) Transaction(txcb TxCallback) error {
+	var jobs []*Job
+	err := q.Queue.Transaction(func(tx Queue) error {
+		jobs = nil
+		return txcb(WrapQueue(tx, &txRecorder{Queue: tx, jobs: &jobs}))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, j := range jobs {
+		q.fire(j, Published, nil)
+	}
+
+	return nil
+}
+
+// txRecorder records the jobs published in a transaction.
+type txRecorder struct {
+	Queue
+	jobs *[]*Job
+}
+
+func (tx *txRecorder) Publish(j *Job) error {
+	if err := tx.Queue.Publish(j); err != nil {
+		return err
+	}
+
+	*tx.jobs = append(*tx.jobs, j)
+	return nil
+}
+
+func (tx *txRecorder) PublishDedup(j *Job) (bool, error) {
+	duplicate, err := PublishDedup(tx.Queue, j)
+	if err == nil && !duplicate {
+		*tx.jobs = append(*tx.jobs, j)
+	}
+
+	return duplicate, err
+}
+
+func (tx *txRecorder) PublishDelayed(j *Job, delay time.Duration) error {
+	if err := tx.Queue.PublishDelayed(j, delay); err != nil {
+		return err
+	}
+
+	*tx.jobs = append(*tx.jobs, j)
+	return nil
+}
+
+// Cancel implements the Canceler interface, if the wrapped Queue does. The
+// Canceled event only carries the ID of the job.
+func (q *hookQueue) Cancel(id string) (bool, error) {
+	ok, err := Cancel(q.Queue, id)
+	if ok && err == nil {
+		q.fire(&Job{ID: id}, Canceled, nil)
+	}
+
+	return ok, err
+}
+
+// Consume implements the Queue interface.
+func (q *hookQueue) Consume(advertisedWindow int) (JobIter, error) {
+	iter, err := q.Queue.Consume(advertisedWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hookIter{JobIter: iter, q: q}, nil
+}
+
+type hookIter struct {
+	JobIter
+	q *hookQueue
+}
+
+// Next implements the JobIter interface.
+func (i *hookIter) Next() (*Job, error) {
+	j, err := i.JobIter.Next()
+	if err != nil || j == nil {
+		return j, err
+	}
+
+	j.Acknowledger = WrapAcknowledger(j.Acknowledger,
+		&hookAcknowledger{Acknowledger: j.Acknowledger, q: i.q, j: j})
+
+	i.q.fire(j, Delivered, nil)
+	return j, nil
+}
+
+// hookAcknowledger fires the events of the first settlement of the job, the
+// next ones don't change its state.
+type hookAcknowledger struct {
+	Acknowledger
+	q *hookQueue
+	j *Job
+
+	mu      sync.Mutex
+	settled bool
+}
+
+// Ack implements the Acknowledger interface.
+func (a *hookAcknowledger) Ack() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.settled {
+		return a.Acknowledger.Ack()
+	}
+
+	err := a.Acknowledger.Ack()
+	a.settled = err == nil
+	a.q.fire(a.j, Acked, err)
+	return err
+}
+
+// Reject implements the Acknowledger interface.
+func (a *hookAcknowledger) Reject(requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.settled {
+		return a.Acknowledger.Reject(requeue)
+	}
+
+	err := a.Acknowledger.Reject(requeue)
+	a.settled = err == nil
+	a.q.hooks.Fire(Event{
+		Queue:      a.q.name,
+		Job:        a.j,
+		Transition: Rejected,
+		Requeue:    requeue,
+		Err:        err,
+	})
+
+	if err == nil && !requeue {
+		a.q.fire(a.j, Buried, nil)
+	}
+
+	return err
+}
@@ -0,0 +1,224 @@
+package mq_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+
+	"github.com/stretchr/testify/require"
+)
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *eventRecorder) OnEvent(e mq.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := e.Queue + " " + e.Transition.String()
+	if e.Requeue {
+		s += " requeue"
+	}
+
+	if e.Err != nil {
+		s += " error"
+	}
+
+	r.events = append(r.events, s)
+}
+
+func (r *eventRecorder) Events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func TestHooks(t *testing.T) {
+	native := func(r *eventRecorder) mq.Broker {
+		return mq.AddHook(memory.New(), r)
+	}
+
+	wrapped := func(r *eventRecorder) mq.Broker {
+		return mq.WithHooks(memory.New(), r)
+	}
+
+	for name, newBroker := range map[string]func(*eventRecorder) mq.Broker{
+		"native":  native,
+		"wrapped": wrapped,
+	} {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			var r eventRecorder
+			q, err := newBroker(&r).Queue("hooks")
+			require.NoError(err)
+
+			require.Error(q.Publish(nil))
+			for i := 0; i < 3; i++ {
+				j := mq.NewJob()
+				require.NoError(j.Encode(i))
+				require.NoError(q.Publish(j))
+			}
+
+			iter, err := q.Consume(0)
+			require.NoError(err)
+
+			for _, settle := range []func(*mq.Job) error{
+				(*mq.Job).Ack,
+				func(j *mq.Job) error { return j.Reject(true) },
+				func(j *mq.Job) error { return j.Reject(false) },
+			} {
+				j, err := iter.Next()
+				require.NoError(err)
+				require.NoError(settle(j))
+
+				// settling again does not fire any event
+				require.NoError(j.Ack())
+				require.NoError(j.Reject(false))
+			}
+
+			require.Equal([]string{
+				"hooks published error",
+				"hooks published",
+				"hooks published",
+				"hooks published",
+				"hooks delivered",
+				"hooks acked",
+				"hooks delivered",
+				"hooks rejected requeue",
+				"hooks delivered",
+				"hooks rejected",
+				"hooks buried",
+			}, r.Events())
+			require.NoError(iter.Close())
+		})
+	}
+}
+
+func TestHooks_order(t *testing.T) {
+	require := require.New(t)
+
+	var r eventRecorder
+	publishing := make(chan struct{})
+	b := mq.AddHook(memory.New(), mq.HookFunc(func(e mq.Event) {
+		if e.Transition == mq.Published {
+			close(publishing)
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		r.OnEvent(e)
+	}))
+
+	q, err := b.Queue("hooks-order")
+	require.NoError(err)
+
+	j := mq.NewJob()
+	require.NoError(j.Encode(true))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- q.Publish(j)
+	}()
+
+	// the job is delivered while its Published event is being fired
+	<-publishing
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.NoError(j.Ack())
+	require.NoError(<-errs)
+
+	require.Equal([]string{
+		"hooks-order published",
+		"hooks-order delivered",
+		"hooks-order acked",
+	}, r.Events())
+}
+
+func TestHooks_callbacks(t *testing.T) {
+	require := require.New(t)
+
+	var published, acked int
+	b := mq.AddHook(memory.New(), &mq.Hooks{
+		OnPublish: func(mq.Event) { published++ },
+		OnAck:     func(mq.Event) { acked++ },
+	})
+
+	q, err := b.Queue("hooks-callbacks")
+	require.NoError(err)
+
+	j := mq.NewJob()
+	require.NoError(j.Encode(true))
+	require.NoError(q.Transaction(func(tx mq.Queue) error {
+		return tx.Publish(j)
+	}))
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.NoError(j.Ack())
+
+	require.Equal(1, published)
+	require.Equal(1, acked)
+}
+
+func TestAsyncHook(t *testing.T) {
+	require := require.New(t)
+
+	var r eventRecorder
+	release := make(chan struct{})
+	h := mq.NewAsyncHook(mq.HookFunc(func(e mq.Event) {
+		<-release
+		r.OnEvent(e)
+	}), 10)
+
+	q, err := mq.AddHook(memory.New(), h).Queue("hooks-async")
+	require.NoError(err)
+
+	j := mq.NewJob()
+	require.NoError(j.Encode(true))
+
+	// the publication does not wait for the hook
+	errs := make(chan error, 1)
+	go func() {
+		errs <- q.Publish(j)
+	}()
+
+	select {
+	case err := <-errs:
+		require.NoError(err)
+	case <-time.After(time.Second):
+		require.FailNow("publish blocked by the hook")
+	}
+
+	close(release)
+	require.NoError(h.Close())
+	require.Equal([]string{"hooks-async published"}, r.Events())
+}
+
+func TestWithHooks_capabilities(t *testing.T) {
+	require := require.New(t)
+
+	b := mq.WithHooks(memory.New(), &eventRecorder{})
+	require.Implements((*mq.Observable)(nil), b)
+	require.Implements((*mq.QueueDeleter)(nil), b)
+	require.Implements((*mq.TopicBroker)(nil), b)
+	require.Implements((*mq.LoggerSetter)(nil), b)
+
+	q, err := b.Queue("hooks")
+	require.NoError(err)
+	require.Implements((*mq.Canceler)(nil), q)
+	require.Implements((*mq.Deduplicator)(nil), q)
+	require.Implements((*mq.DeadLetterer)(nil), q)
+	require.Implements((*mq.Inspector)(nil), q)
+}
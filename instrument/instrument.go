@@ -0,0 +1,306 @@
+// Package instrument implements the instrumentation of any mq.Broker,
+// counting and timing the operations on its queues. The metrics are kept in a
+// Registry, which exposes them in the Prometheus text format.
+package instrument
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+)
+
+// Names of the metrics. All of them have a "queue" label.
+const (
+	// Published counts the jobs published.
+	Published = "mq_published_total"
+	// PublishedDelayed counts the jobs published with a delay.
+	PublishedDelayed = "mq_published_delayed_total"
+	// PublishErrors counts the failed publications.
+	PublishErrors = "mq_publish_errors_total"
+	// Delivered counts the jobs delivered to consumers.
+	Delivered = "mq_delivered_total"
+	// Acked counts the jobs acknowledged.
+	Acked = "mq_acked_total"
+	// Rejected counts the jobs rejected, by the "requeue" label.
+	Rejected = "mq_rejected_total"
+	// Transactions counts the transactions, by the "result" label, either
+	// "commit" or "rollback".
+	Transactions = "mq_transactions_total"
+	// Republished counts the buried jobs republished.
+	Republished = "mq_republished_total"
+	// PublishDuration is the histogram of the time taken to publish.
+	PublishDuration = "mq_publish_duration_seconds"
+	// ProcessingDuration is the histogram of the time between the delivery
+	// of a job and its acknowledgement.
+	ProcessingDuration = "mq_processing_duration_seconds"
+	// DeliveryLag is the histogram of the time between the creation of a job,
+	// its Timestamp, and its delivery.
+	DeliveryLag = "mq_delivery_lag_seconds"
+)
+
+var help = map[string]string{
+	Published:          "Number of jobs published.",
+	PublishedDelayed:   "Number of jobs published with a delay.",
+	PublishErrors:      "Number of failed publications.",
+	Delivered:          "Number of jobs delivered to consumers.",
+	Acked:              "Number of jobs acknowledged.",
+	Rejected:           "Number of jobs rejected.",
+	Transactions:       "Number of transactions.",
+	Republished:        "Number of buried jobs republished.",
+	PublishDuration:    "Time taken to publish a job.",
+	ProcessingDuration: "Time between the delivery of a job and its acknowledgement.",
+	DeliveryLag:        "Time between the creation of a job and its delivery.",
+}
+
+// New returns a Broker recording the metrics of the given Broker in the
+// Registry. The stats of the queues implementing mq.Inspector are exposed as
+// the mq_queue_jobs gauge, until the queue is deleted. The metrics of the
+// queues with the same name in different Brokers sharing the Registry are
+// added up. The deliveries and settlements of the jobs of a Broker
+// instrumented twice with the same Registry are counted once, the
+// settlements by the outermost layer.
+func New(b mq.Broker, r *Registry) mq.Broker {
+	w := &broker{Broker: b, r: r}
+	if _, ok := b.(mq.QueueDeleter); ok {
+		return mq.WrapBroker(b, &deleter{w})
+	}
+
+	return mq.WrapBroker(b, w)
+}
+
+type broker struct {
+	mq.Broker
+	r *Registry
+}
+
+// deleter is a broker whose Broker implements mq.QueueDeleter.
+type deleter struct {
+	*broker
+}
+
+// DeleteQueue implements the mq.QueueDeleter interface, the stats of the
+// deleted queue are not exposed anymore.
+func (b *deleter) DeleteQueue(name string) error {
+	if err := mq.DeleteQueue(b.Broker, name); err != nil {
+		return err
+	}
+
+	b.r.forget(b.broker, name)
+	return nil
+}
+
+// Queue implements the mq.Broker interface.
+func (b *broker) Queue(name string) (mq.Queue, error) {
+	q, err := b.Broker.Queue(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if i, ok := q.(mq.Inspector); ok {
+		b.r.inspect(b, name, i)
+	}
+
+	return mq.WrapQueue(q, &queue{Queue: q, name: name, r: b.r}), nil
+}
+
+type queue struct {
+	mq.Queue
+	name string
+	r    *Registry
+	// committed, in the queues of a transaction, are the metrics to record
+	// once it is committed.
+	committed *[]func()
+}
+
+func (q *queue) add(name string, labels ...string) {
+	q.r.Add(name, help[name], 1, append([]string{"queue", q.name}, labels...)...)
+}
+
+// published records the metrics of a job published, once the transaction is
+// committed if it was published in one.
+func (q *queue) published(name string, d time.Duration) {
+	record := func() {
+		q.observe(PublishDuration, d)
+		q.add(name)
+	}
+
+	if q.committed != nil {
+		*q.committed = append(*q.committed, record)
+		return
+	}
+
+	record()
+}
+
+func (q *queue) observe(name string, d time.Duration) {
+	q.r.Observe(name, help[name], d.Seconds(), "queue", q.name)
+}
+
+// Publish implements the mq.Queue interface.
+func (q *queue) Publish(j *mq.Job) error {
+	start := time.Now()
+	if err := q.Queue.Publish(j); err != nil {
+		q.add(PublishErrors)
+		return err
+	}
+
+	q.published(Published, time.Since(start))
+	return nil
+}
+
+// PublishDedup implements the mq.Deduplicator interface, the duplicates are
+// not counted as published.
+func (q *queue) PublishDedup(j *mq.Job) (bool, error) {
+	start := time.Now()
+	duplicate, err := mq.PublishDedup(q.Queue, j)
+	if err != nil {
+		q.add(PublishErrors)
+		return false, err
+	}
+
+	if !duplicate {
+		q.published(Published, time.Since(start))
+	}
+
+	return duplicate, nil
+}
+
+// PublishDelayed implements the mq.Queue interface.
+func (q *queue) PublishDelayed(j *mq.Job, delay time.Duration) error {
+	start := time.Now()
+	if err := q.Queue.PublishDelayed(j, delay); err != nil {
+		q.add(PublishErrors)
+		return err
+	}
+
+	q.published(PublishedDelayed, time.Since(start))
+	return nil
+}
+
+// Transaction implements the mq.Queue interface, the jobs published in the
+// transaction are counted too once it is committed.
+func (q *queue) Transaction(txcb mq.TxCallback) error {
+	var committed []func()
+	err := q.Queue.Transaction(func(tx mq.Queue) error {
+		committed = nil
+		return txcb(mq.WrapQueue(tx, &queue{
+			Queue:     tx,
+			name:      q.name,
+			r:         q.r,
+			committed: &committed,
+		}))
+	})
+
+	if err != nil {
+		q.add(Transactions, "result", "rollback")
+		return err
+	}
+
+	q.add(Transactions, "result", "commit")
+	for _, record := range committed {
+		record()
+	}
+
+	return nil
+}
+
+// RepublishBuried implements the mq.Queue interface, the jobs complying with
+// the conditions are counted.
+func (q *queue) RepublishBuried(conditions ...mq.RepublishConditionFunc) error {
+	var republished int
+	err := q.Queue.RepublishBuried(func(j *mq.Job) bool {
+		if !mq.RepublishConditions(conditions).Comply(j) {
+			return false
+		}
+
+		republished++
+		return true
+	})
+
+	if err != nil {
+		return err
+	}
+
+	q.r.Add(Republished, help[Republished], float64(republished), "queue", q.name)
+	return nil
+}
+
+// Consume implements the mq.Queue interface.
+func (q *queue) Consume(advertisedWindow int) (mq.JobIter, error) {
+	iter, err := q.Queue.Consume(advertisedWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jobIter{JobIter: iter, q: q}, nil
+}
+
+type jobIter struct {
+	mq.JobIter
+	q *queue
+}
+
+// Next implements the mq.JobIter interface.
+func (i *jobIter) Next() (*mq.Job, error) {
+	j, err := i.JobIter.Next()
+	if err != nil || j == nil {
+		return j, err
+	}
+
+	now := time.Now()
+	inner, counted := mq.FindAcknowledger(j.Acknowledger, i.counts)
+	if counted {
+		// an inner layer sharing the Registry already counted the delivery,
+		// the settlement is counted here instead.
+		inner.(*acknowledger).muted = true
+		now = inner.(*acknowledger).start
+	} else {
+		i.q.add(Delivered)
+		if !j.Timestamp.IsZero() {
+			i.q.observe(DeliveryLag, now.Sub(j.Timestamp))
+		}
+	}
+
+	j.Acknowledger = mq.WrapAcknowledger(j.Acknowledger,
+		&acknowledger{Acknowledger: j.Acknowledger, q: i.q, start: now})
+
+	return j, nil
+}
+
+// counts returns true if the Acknowledger records the metrics of the same
+// queue in the same Registry.
+func (i *jobIter) counts(a mq.Acknowledger) bool {
+	ia, ok := a.(*acknowledger)
+	return ok && ia.q.r == i.q.r && ia.q.name == i.q.name
+}
+
+type acknowledger struct {
+	mq.Acknowledger
+	q     *queue
+	start time.Time
+	// muted is set when an outer layer counts the settlement of the job.
+	muted bool
+}
+
+// Ack implements the mq.Acknowledger interface.
+func (a *acknowledger) Ack() error {
+	if err := a.Acknowledger.Ack(); err != nil || a.muted {
+		return err
+	}
+
+	a.q.observe(ProcessingDuration, time.Since(a.start))
+	a.q.add(Acked)
+	return nil
+}
+
+// Reject implements the mq.Acknowledger interface.
+func (a *acknowledger) Reject(requeue bool) error {
+	if err := a.Acknowledger.Reject(requeue); err != nil || a.muted {
+		return err
+	}
+
+	a.q.observe(ProcessingDuration, time.Since(a.start))
+	a.q.add(Rejected, "requeue", strconv.FormatBool(requeue))
+	return nil
+}
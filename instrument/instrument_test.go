@@ -0,0 +1,170 @@
+package instrument
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+	"github.com/go-mq/mq/v2/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrument(t *testing.T) {
+	require := require.New(t)
+
+	r := NewRegistry()
+	b := New(memory.New(), r)
+
+	q, err := b.Queue("jobs")
+	require.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(q.Publish(test.NewJob(t, true)))
+	}
+	require.Error(q.Publish(nil))
+	require.NoError(q.PublishDelayed(test.NewJob(t, true), time.Hour))
+
+	require.NoError(q.Transaction(func(tx mq.Queue) error {
+		return tx.Publish(test.NewJob(t, true))
+	}))
+	// the jobs published in a transaction rolled back are not counted
+	require.Error(q.Transaction(func(tx mq.Queue) error {
+		require.NoError(tx.Publish(test.NewJob(t, true)))
+		return errors.New("rollback")
+	}))
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.NoError(j.Ack())
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.NoError(j.Reject(false))
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.NoError(j.Reject(true))
+
+	require.NoError(q.RepublishBuried())
+	require.NoError(q.RepublishBuried())
+
+	// one job is left in flight
+	_, err = iter.Next()
+	require.NoError(err)
+
+	require.Equal(4.0, r.Value(Published, "queue", "jobs"))
+	require.Equal(1.0, r.Value(PublishedDelayed, "queue", "jobs"))
+	require.Equal(1.0, r.Value(PublishErrors, "queue", "jobs"))
+	require.Equal(5.0, r.Value(PublishDuration, "queue", "jobs"))
+	require.Equal(1.0, r.Value(Transactions, "queue", "jobs", "result", "commit"))
+	require.Equal(1.0, r.Value(Transactions, "queue", "jobs", "result", "rollback"))
+	require.Equal(4.0, r.Value(Delivered, "queue", "jobs"))
+	require.Equal(4.0, r.Value(DeliveryLag, "queue", "jobs"))
+	require.Equal(1.0, r.Value(Acked, "queue", "jobs"))
+	require.Equal(1.0, r.Value(Rejected, "queue", "jobs", "requeue", "false"))
+	require.Equal(1.0, r.Value(Rejected, "queue", "jobs", "requeue", "true"))
+	require.Equal(3.0, r.Value(ProcessingDuration, "queue", "jobs"))
+	require.Equal(1.0, r.Value(Republished, "queue", "jobs"))
+
+	// the queues with the same name of other brokers are added up
+	other, err := New(memory.New(), r).Queue("jobs")
+	require.NoError(err)
+	require.NoError(other.Publish(test.NewJob(t, true)))
+
+	var buf bytes.Buffer
+	require.NoError(r.WritePrometheus(&buf))
+
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE mq_published_total counter\n",
+		"mq_published_total{queue=\"jobs\"} 5\n",
+		"mq_rejected_total{queue=\"jobs\",requeue=\"true\"} 1\n",
+		"# TYPE mq_processing_duration_seconds histogram\n",
+		"mq_processing_duration_seconds_bucket{queue=\"jobs\",le=\"+Inf\"} 3\n",
+		"mq_processing_duration_seconds_count{queue=\"jobs\"} 3\n",
+		"# TYPE mq_queue_jobs gauge\n",
+		"mq_queue_jobs{queue=\"jobs\",state=\"ready\"} 3\n",
+		"mq_queue_jobs{queue=\"jobs\",state=\"delayed\"} 1\n",
+		"mq_queue_jobs{queue=\"jobs\",state=\"in_flight\"} 1\n",
+		"mq_queue_jobs{queue=\"jobs\",state=\"buried\"} 0\n",
+	} {
+		require.Contains(out, line)
+	}
+}
+
+func TestInstrument_capabilities(t *testing.T) {
+	require := require.New(t)
+
+	b := New(memory.New(), NewRegistry())
+	require.Implements((*mq.Observable)(nil), b)
+	require.Implements((*mq.QueueDeleter)(nil), b)
+	require.Implements((*mq.TopicBroker)(nil), b)
+	require.Implements((*mq.LoggerSetter)(nil), b)
+
+	q, err := b.Queue("jobs")
+	require.NoError(err)
+	require.Implements((*mq.Canceler)(nil), q)
+	require.Implements((*mq.Deduplicator)(nil), q)
+	require.Implements((*mq.DeadLetterer)(nil), q)
+	require.Implements((*mq.Inspector)(nil), q)
+}
+
+func TestInstrument_twice(t *testing.T) {
+	require := require.New(t)
+
+	r := NewRegistry()
+	q, err := New(New(memory.New(), r), r).Queue("jobs")
+	require.NoError(err)
+	require.NoError(q.Publish(test.NewJob(t, true)))
+	require.NoError(q.Publish(test.NewJob(t, true)))
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.NoError(j.Ack())
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.NoError(j.Reject(false))
+
+	require.Equal(2.0, r.Value(Delivered, "queue", "jobs"))
+	require.Equal(2.0, r.Value(DeliveryLag, "queue", "jobs"))
+	require.Equal(1.0, r.Value(Acked, "queue", "jobs"))
+	require.Equal(1.0, r.Value(Rejected, "queue", "jobs", "requeue", "false"))
+	require.Equal(2.0, r.Value(ProcessingDuration, "queue", "jobs"))
+}
+
+func TestInstrument_DeleteQueue(t *testing.T) {
+	require := require.New(t)
+
+	r := NewRegistry()
+	b := New(memory.New(), r)
+	q, err := b.Queue("jobs")
+	require.NoError(err)
+	require.NoError(q.Publish(test.NewJob(t, true)))
+
+	var buf bytes.Buffer
+	require.NoError(r.WritePrometheus(&buf))
+	require.Contains(buf.String(), "mq_queue_jobs{queue=\"jobs\",state=\"ready\"} 1\n")
+
+	require.NoError(mq.DeleteQueue(b, "jobs"))
+	buf.Reset()
+	require.NoError(r.WritePrometheus(&buf))
+	require.NotContains(buf.String(), "mq_queue_jobs{queue=\"jobs\"")
+	require.Contains(buf.String(), "mq_published_total{queue=\"jobs\"} 1\n")
+
+	// the queue is not deletable if the Broker does not support it
+	_, ok := New(struct{ mq.Broker }{memory.New()}, r).(mq.QueueDeleter)
+	require.False(ok)
+}
@@ -0,0 +1,308 @@
+package instrument
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-mq/mq/v2"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of the
+// histograms.
+var DefaultBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300,
+}
+
+// Registry holds the metrics of the instrumented Brokers and exposes them in
+// the Prometheus text format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+	queues  map[inspected]mq.Inspector
+}
+
+// inspected is a queue of an instrumented Broker.
+type inspected struct {
+	b    *broker
+	name string
+}
+
+// NewRegistry returns a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*metric),
+		queues:  make(map[inspected]mq.Inspector),
+	}
+}
+
+type kind string
+
+const (
+	counter   kind = "counter"
+	gauge     kind = "gauge"
+	histogram kind = "histogram"
+)
+
+type metric struct {
+	name   string
+	help   string
+	kind   kind
+	series map[string]*series
+}
+
+type series struct {
+	labels  string
+	value   float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// Add adds the value to the counter with the given name and labels, given as
+// name and value pairs.
+func (r *Registry) Add(name, help string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series(name, help, counter, labels).value += v
+}
+
+// Observe records the value in the histogram with the given name and labels,
+// given as name and value pairs.
+func (r *Registry) Observe(name, help string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.series(name, help, histogram, labels)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(DefaultBuckets))
+	}
+
+	for i, upper := range DefaultBuckets {
+		if v <= upper {
+			s.buckets[i]++
+		}
+	}
+
+	s.sum += v
+	s.count++
+}
+
+// Value returns the value of the counter, or the count of the histogram,
+// with the given name and labels.
+func (r *Registry) Value(name string, labels ...string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.metrics[name]
+	if !ok {
+		return 0
+	}
+
+	s, ok := m.series[formatLabels(labels)]
+	if !ok {
+		return 0
+	}
+
+	if m.kind == histogram {
+		return float64(s.count)
+	}
+
+	return s.value
+}
+
+func (r *Registry) series(name, help string, k kind, labels []string) *series {
+	m, ok := r.metrics[name]
+	if !ok {
+		m = &metric{name: name, help: help, kind: k, series: make(map[string]*series)}
+		r.metrics[name] = m
+	}
+
+	key := formatLabels(labels)
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: key}
+		m.series[key] = s
+	}
+
+	return s
+}
+
+// inspect registers a queue of the Broker whose stats are exposed as gauges.
+func (r *Registry) inspect(b *broker, name string, q mq.Inspector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queues[inspected{b: b, name: name}] = q
+}
+
+// forget unregisters a deleted queue of the Broker, its gauges are removed
+// once no other Broker has a queue with the same name.
+func (r *Registry) forget(b *broker, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.queues, inspected{b: b, name: name})
+	for key := range r.queues {
+		if key.name == name {
+			return
+		}
+	}
+
+	m, ok := r.metrics[queueJobs]
+	if !ok {
+		return
+	}
+
+	for _, state := range states {
+		delete(m.series, formatLabels([]string{"queue", name, "state", state}))
+	}
+}
+
+// WritePrometheus writes all the metrics in the Prometheus text format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.collect()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		r.metrics[name].write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// ServeHTTP implements the http.Handler interface, serving the metrics in
+// the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WritePrometheus(w)
+}
+
+// collect updates the gauges with the stats of the inspected queues, adding
+// up the queues with the same name.
+func (r *Registry) collect() {
+	r.mu.Lock()
+	queues := make(map[inspected]mq.Inspector, len(r.queues))
+	for key, q := range r.queues {
+		queues[key] = q
+	}
+	r.mu.Unlock()
+
+	totals := make(map[string]mq.QueueStats)
+	for key, q := range queues {
+		stats, err := q.Stats()
+		if err != nil {
+			continue
+		}
+
+		total := totals[key.name]
+		total.Ready += stats.Ready
+		total.Delayed += stats.Delayed
+		total.InFlight += stats.InFlight
+		total.Buried += stats.Buried
+		totals[key.name] = total
+	}
+
+	for name, stats := range totals {
+		r.mu.Lock()
+		for i, v := range []int{
+			stats.Ready,
+			stats.Delayed,
+			stats.InFlight,
+			stats.Buried,
+		} {
+			r.series(
+				queueJobs,
+				"Number of jobs in the queue by state.",
+				gauge,
+				[]string{"queue", name, "state", states[i]},
+			).value = float64(v)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// queueJobs is the gauge of the stats of the inspected queues, by the
+// states.
+const queueJobs = "mq_queue_jobs"
+
+var states = []string{"ready", "delayed", "in_flight", "buried"}
+
+func (m *metric) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != histogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, braces(s.labels), formatFloat(s.value))
+			continue
+		}
+
+		for i, upper := range DefaultBuckets {
+			le := `le="` + formatFloat(upper) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, braces(join(s.labels, le)), s.buckets[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, braces(join(s.labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, braces(s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, braces(s.labels), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func join(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+
+	return labels + "," + label
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
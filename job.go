@@ -31,10 +31,39 @@ type Job struct {
 	Timestamp time.Time
 	// Retries is the number of times this job can be processed before being rejected.
 	Retries int32
+	// Deliveries is the number of times the job has been delivered to a
+	// consumer, including the current delivery.
+	Deliveries int32
+	// Redelivered is true if the job was delivered before.
+	Redelivered bool
+	// FirstDelivery is the time of the first delivery of the job.
+	FirstDelivery time.Time
+	// LastDelivery is the time of the current delivery of the job.
+	LastDelivery time.Time
 	// ErrorType is the kind of error that made the job fail.
 	ErrorType string
+	// DeadLetterOrigin is the name of the queue the job was dead-lettered
+	// from, empty if the job was never dead-lettered.
+	DeadLetterOrigin string
+	// DeadLetterReason is the reason why the job was dead-lettered, see
+	// DeadLetterRejected and DeadLetterExpired.
+	DeadLetterReason string
 	// ContentType of the job
 	ContentType contentType
+	// DedupKey is the key used to detect duplicated publications of the job,
+	// the ID is used if empty.
+	DedupKey string
+	// UniqueKey, if not empty, prevents publishing the job while another job
+	// with the same key is ready, delayed or running in the same queue, see
+	// UniquePolicy. The key is released when the job is acknowledged or
+	// buried.
+	UniqueKey string
+	// GroupKey, if not empty, makes the job part of an ordered group: the jobs
+	// of a group are delivered in order and one at a time, the next one is
+	// not delivered until the one in flight is acknowledged or rejected.
+	GroupKey string
+	// Headers are arbitrary metadata of the Job, such as routing information.
+	Headers map[string]string
 	// Raw content of the Job
 	Raw []byte
 	// Acknowledger is the acknowledgement management system for the job.
@@ -53,6 +82,21 @@ type Acknowledger interface {
 	Reject(requeue bool) error
 }
 
+// Extender is implemented by the Acknowledgers able to extend the lease of
+// a job, so it is not delivered again while it's still being processed.
+type Extender interface {
+	// Extend extends the lease of the job to the given duration from now.
+	Extend(time.Duration) error
+}
+
+// ProgressReporter is implemented by the Acknowledgers able to record the
+// progress of a job while it's being processed.
+type ProgressReporter interface {
+	// ReportProgress records the percent of the job completed, from 0 to
+	// 100, and a status message.
+	ReportProgress(percent float64, message string) error
+}
+
 // NewJob creates a new Job with default values, a new unique ID and current
 // timestamp.
 func NewJob() *Job {
@@ -69,6 +113,16 @@ func (j *Job) SetPriority(priority Priority) {
 	j.Priority = priority
 }
 
+// DeduplicationKey returns the key used to detect duplicated publications of
+// the job, its DedupKey or its ID if not set.
+func (j *Job) DeduplicationKey() string {
+	if j.DedupKey != "" {
+		return j.DedupKey
+	}
+
+	return j.ID
+}
+
 // Encode encodes the payload to the wire format used.
 func (j *Job) Encode(payload interface{}) error {
 	var err error
@@ -105,6 +159,49 @@ func (j *Job) Reject(requeue bool) error {
 	return j.Acknowledger.Reject(requeue)
 }
 
+// ErrExtendNotSupported is the error returned when the lease of the Job can't
+// be extended.
+var ErrExtendNotSupported = errors.NewKind("can't extend the lease of this message, not supported")
+
+// CanExtend returns true if the lease of the job can be extended.
+func (j *Job) CanExtend() bool {
+	_, ok := j.Acknowledger.(Extender)
+	return ok
+}
+
+// Extend extends the lease of the job to the given duration from now.
+func (j *Job) Extend(d time.Duration) error {
+	if j.Acknowledger == nil {
+		return ErrCantAck.New()
+	}
+
+	e, ok := j.Acknowledger.(Extender)
+	if !ok {
+		return ErrExtendNotSupported.New()
+	}
+
+	return e.Extend(d)
+}
+
+// ErrProgressNotSupported is the error returned when the progress of the Job
+// can't be reported.
+var ErrProgressNotSupported = errors.NewKind("can't report the progress of this message, not supported")
+
+// ReportProgress reports the percent of the job completed, from 0 to 100, and
+// a status message, see ProgressReporter.
+func (j *Job) ReportProgress(percent float64, message string) error {
+	if j.Acknowledger == nil {
+		return ErrCantAck.New()
+	}
+
+	r, ok := j.Acknowledger.(ProgressReporter)
+	if !ok {
+		return ErrProgressNotSupported.New()
+	}
+
+	return r.ReportProgress(percent, message)
+}
+
 // Size returns the size of the message.
 func (j *Job) Size() int {
 	return len(j.Raw)
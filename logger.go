@@ -0,0 +1,145 @@
+package mq
+
+import (
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Names of the fields logged by the brokers.
+const (
+	QueueField = "queue"
+	JobIDField = "job_id"
+	ErrorField = "error"
+	// ReasonField is the reason a job was buried, see DeadLetterExpired
+	// and DeadLetterRejected.
+	ReasonField          = "reason"
+	DeadLetterQueueField = "dead_letter_queue"
+	// RequeueField tells whether a rejected job was put back in the queue.
+	RequeueField = "requeue"
+	// DeliveriesField is the number of deliveries of a job.
+	DeliveriesField = "deliveries"
+	// UnackedField is the number of jobs not settled when an iterator was
+	// closed.
+	UnackedField = "unacked"
+	// ReadyField, DelayedField and BuriedField are the number of jobs in
+	// every state dropped when a queue was deleted.
+	ReadyField   = "ready"
+	DelayedField = "delayed"
+	BuriedField  = "buried"
+)
+
+// Fields are the structured fields of a log entry.
+type Fields map[string]interface{}
+
+// Logger logs the events of a Broker. The implementations must be safe for
+// concurrent use.
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+// LoggerSetter is implemented by the brokers able to log their events. They
+// log nothing until a Logger is set.
+type LoggerSetter interface {
+	SetLogger(Logger)
+}
+
+// SetLogger sets the Logger of the Broker, it returns false if the Broker
+// does not implement LoggerSetter.
+func SetLogger(b Broker, l Logger) bool {
+	s, ok := b.(LoggerSetter)
+	if ok {
+		s.SetLogger(l)
+	}
+
+	return ok
+}
+
+// NopLogger is a Logger discarding everything.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, Fields) {}
+func (nopLogger) Info(string, Fields)  {}
+func (nopLogger) Warn(string, Fields)  {}
+func (nopLogger) Error(string, Fields) {}
+
+// NewLogrusLogger returns a Logger writing to the given logrus logger, such
+// as logrus.StandardLogger() or a logrus.Entry.
+func NewLogrusLogger(l logrus.FieldLogger) Logger {
+	return &logrusLogger{l}
+}
+
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+func (l *logrusLogger) Debug(msg string, fields Fields) {
+	l.l.WithFields(logrus.Fields(fields)).Debug(msg)
+}
+
+func (l *logrusLogger) Info(msg string, fields Fields) {
+	l.l.WithFields(logrus.Fields(fields)).Info(msg)
+}
+
+func (l *logrusLogger) Warn(msg string, fields Fields) {
+	l.l.WithFields(logrus.Fields(fields)).Warn(msg)
+}
+
+func (l *logrusLogger) Error(msg string, fields Fields) {
+	l.l.WithFields(logrus.Fields(fields)).Error(msg)
+}
+
+// KVLogger is a logger taking the fields as alternating keys and values,
+// such as the *slog.Logger of the log/slog package.
+type KVLogger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// NewKVLogger returns a Logger writing to the given KVLogger. The fields are
+// passed sorted by key.
+func NewKVLogger(l KVLogger) Logger {
+	return &kvLogger{l}
+}
+
+type kvLogger struct {
+	l KVLogger
+}
+
+func (l *kvLogger) Debug(msg string, fields Fields) {
+	l.l.Debug(msg, keyValues(fields)...)
+}
+
+func (l *kvLogger) Info(msg string, fields Fields) {
+	l.l.Info(msg, keyValues(fields)...)
+}
+
+func (l *kvLogger) Warn(msg string, fields Fields) {
+	l.l.Warn(msg, keyValues(fields)...)
+}
+
+func (l *kvLogger) Error(msg string, fields Fields) {
+	l.l.Error(msg, keyValues(fields)...)
+}
+
+func keyValues(fields Fields) []interface{} {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	args := make([]interface{}, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, k, fields[k])
+	}
+
+	return args
+}
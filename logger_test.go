@@ -0,0 +1,36 @@
+package mq_test
+
+import (
+	"testing"
+
+	"github.com/go-mq/mq/v2"
+
+	"github.com/stretchr/testify/require"
+)
+
+type kvRecorder struct {
+	entries [][]interface{}
+}
+
+func (r *kvRecorder) log(level, msg string, args ...interface{}) {
+	r.entries = append(r.entries, append([]interface{}{level, msg}, args...))
+}
+
+func (r *kvRecorder) Debug(msg string, args ...interface{}) { r.log("debug", msg, args...) }
+func (r *kvRecorder) Info(msg string, args ...interface{})  { r.log("info", msg, args...) }
+func (r *kvRecorder) Warn(msg string, args ...interface{})  { r.log("warn", msg, args...) }
+func (r *kvRecorder) Error(msg string, args ...interface{}) { r.log("error", msg, args...) }
+
+func TestKVLogger(t *testing.T) {
+	require := require.New(t)
+
+	var r kvRecorder
+	l := mq.NewKVLogger(&r)
+	l.Warn("publish failed", mq.Fields{mq.QueueField: "q", mq.JobIDField: "1"})
+	l.Debug("iterator closed", nil)
+
+	require.Equal([][]interface{}{
+		{"warn", "publish failed", mq.JobIDField, "1", mq.QueueField, "q"},
+		{"debug", "iterator closed"},
+	}, r.entries)
+}
@@ -1,13 +1,19 @@
 package memory
 
 import (
+	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-mq/mq/v2"
 )
 
+// errGroupsBusy is returned by JobIter.next when there are ready jobs, but
+// all of them belong to groups with a job in flight.
+var errGroupsBusy = errors.New("all the groups have a job in flight")
+
 func init() {
 	mq.Register("memory", func(uri string) (mq.Broker, error) {
 		return New(), nil
@@ -20,8 +26,12 @@ func init() {
 
 // Broker is a in-memory implementation of Broker.
 type Broker struct {
-	queues map[string]mq.Queue
+	queues map[string]*Queue
+	topics map[string]*Topic
 	finite bool
+	logger atomic.Value
+	hooks  mq.HookSet
+	sync.Mutex
 }
 
 // New creates a new Broker for an in-memory queue.
@@ -33,21 +43,72 @@ func New() mq.Broker {
 // specifies if the JobIter stops on EOF or not.
 func NewFinite(finite bool) mq.Broker {
 	return &Broker{
-		queues: make(map[string]mq.Queue),
+		queues: make(map[string]*Queue),
+		topics: make(map[string]*Topic),
 		finite: finite,
 	}
 }
 
 // Queue returns the queue with the given name.
 func (b *Broker) Queue(name string) (mq.Queue, error) {
+	return b.queue(name), nil
+}
+
+func (b *Broker) queue(name string) *Queue {
+	b.Lock()
+	defer b.Unlock()
 	if _, ok := b.queues[name]; !ok {
-		b.queues[name] = &Queue{
-			jobs:   make([]*mq.Job, 0, 10),
-			finite: b.finite,
-		}
+		b.queues[name] = b.newQueue(name)
 	}
 
-	return b.queues[name], nil
+	return b.queues[name]
+}
+
+func (b *Broker) newQueue(name string) *Queue {
+	return &Queue{
+		name:   name,
+		b:      b,
+		jobs:   make([]*mq.Job, 0, 10),
+		finite: b.finite,
+	}
+}
+
+// DeleteQueue implements the mq.QueueDeleter interface. The delayed jobs of
+// the queue are dropped too. The Queue values and iterators of the deleted
+// queue must not be used anymore.
+func (b *Broker) DeleteQueue(name string) error {
+	b.Lock()
+	q, ok := b.queues[name]
+	delete(b.queues, name)
+	b.Unlock()
+	if !ok {
+		return nil
+	}
+
+	q.drop()
+	return nil
+}
+
+// drop drops the ready, delayed and buried jobs of the queue, stopping the
+// timers of the delayed ones, and logs how many were dropped.
+func (q *Queue) drop() {
+	defer q.flush()
+	q.Lock()
+	defer q.Unlock()
+
+	f := q.fields(nil)
+	f[mq.ReadyField] = len(q.jobs)
+	f[mq.DelayedField] = len(q.delayed)
+	f[mq.BuriedField] = len(q.buriedJobs)
+	q.queueLog(infoLevel, "queue deleted", f)
+
+	for j, timer := range q.delayed {
+		timer.Stop()
+		delete(q.delayed, j)
+	}
+
+	q.jobs = nil
+	q.buriedJobs = nil
 }
 
 // Close closes the connection in the Broker.
@@ -55,75 +116,751 @@ func (b *Broker) Close() error {
 	return nil
 }
 
+// AddHook implements the mq.Observable interface.
+func (b *Broker) AddHook(h mq.Hook) {
+	b.hooks.AddHook(h)
+}
+
+// SetLogger implements the mq.LoggerSetter interface.
+func (b *Broker) SetLogger(l mq.Logger) {
+	if l == nil {
+		l = mq.NopLogger
+	}
+
+	b.logger.Store(&l)
+}
+
+// logging returns true if a Logger was set.
+func (b *Broker) logging() bool {
+	return b.logger.Load() != nil
+}
+
+func (b *Broker) log() mq.Logger {
+	if l, ok := b.logger.Load().(*mq.Logger); ok {
+		return *l
+	}
+
+	return mq.NopLogger
+}
+
 // Queue implements a queue.Queue interface.
 type Queue struct {
+	name       string
+	b          *Broker
 	jobs       []*mq.Job
 	buriedJobs []*mq.Job
+	deadLetter mq.DeadLetterPolicy
+
+	dedupWindow time.Duration
+	// seen holds the time the dedup keys within the dedup window were
+	// published, and seenOrder the keys in publishing order.
+	seen      map[string]time.Time
+	seenOrder []seenKey
+
+	uniquePolicy mq.UniquePolicy
+	unique       map[string]bool
+	delayed      map[*mq.Job]*time.Timer
+
+	// groups holds the group keys with a job in flight.
+	groups map[string]bool
+	// inFlight is the number of active leases.
+	inFlight int
+	// leased holds the number of active leases of every job ID, and
+	// canceled the IDs of the leased jobs canceled.
+	leased   map[string]int
+	canceled map[string]bool
+	// events are the events to be fired once the queue lock is released,
+	// and firing tells whether they are being fired.
+	events []mq.Event
+	firing bool
+	// logs are the log entries to be written once the queue lock is
+	// released.
+	logs []logEntry
+
+	// parent is the queue of a transaction queue, the jobs published in the
+	// transaction are checked by the parent when it's committed.
+	parent *Queue
+
 	sync.RWMutex
-	idx                int
 	publishImmediately bool
 	finite             bool
 }
 
-// Publish publishes a Job to the queue.
+// log returns the Logger of the broker of the queue.
+func (q *Queue) log() mq.Logger {
+	if q.b == nil {
+		return mq.NopLogger
+	}
+
+	return q.b.log()
+}
+
+// fields returns the log fields of the given job in the queue.
+func (q *Queue) fields(j *mq.Job) mq.Fields {
+	f := mq.Fields{mq.QueueField: q.name}
+	if j != nil {
+		f[mq.JobIDField] = j.ID
+	}
+
+	return f
+}
+
+// emit queues an event to be fired by flush. Must be called with the queue
+// lock held.
+func (q *Queue) emit(e mq.Event) {
+	if q.b == nil || q.b.hooks.Empty() {
+		return
+	}
+
+	e.Queue = q.name
+	e.Time = time.Now()
+	q.events = append(q.events, e)
+}
+
+type logLevel int
+
+const (
+	debugLevel logLevel = iota
+	infoLevel
+	warnLevel
+	errorLevel
+)
+
+// logEntry is a log entry to be written by flush.
+type logEntry struct {
+	level  logLevel
+	msg    string
+	fields mq.Fields
+}
+
+func (e logEntry) write(l mq.Logger) {
+	switch e.level {
+	case debugLevel:
+		l.Debug(e.msg, e.fields)
+	case infoLevel:
+		l.Info(e.msg, e.fields)
+	case warnLevel:
+		l.Warn(e.msg, e.fields)
+	default:
+		l.Error(e.msg, e.fields)
+	}
+}
+
+// queueLog queues a log entry to be written by flush, so a slow Logger does
+// not stall the queue. Must be called with the queue lock held.
+func (q *Queue) queueLog(level logLevel, msg string, f mq.Fields) {
+	if q.b == nil || !q.b.logging() {
+		return
+	}
+
+	q.logs = append(q.logs, logEntry{level: level, msg: msg, fields: f})
+}
+
+// flush writes the queued log entries and fires the emitted events. Must be
+// called without the queue lock held, so the hooks can use the queue. The
+// events of the queue are fired by one goroutine at a time, so they are
+// received in the order they happened: if they are already being fired, the
+// new ones are left to that goroutine.
+func (q *Queue) flush() {
+	if q.b == nil {
+		return
+	}
+
+	if q.b.logging() {
+		q.Lock()
+		logs := q.logs
+		q.logs = nil
+		q.Unlock()
+
+		l := q.log()
+		for _, e := range logs {
+			e.write(l)
+		}
+	}
+
+	if q.b.hooks.Empty() {
+		return
+	}
+
+	q.Lock()
+	if q.firing {
+		q.Unlock()
+		return
+	}
+
+	q.firing = true
+	for len(q.events) > 0 {
+		events := q.events
+		q.events = nil
+		q.Unlock()
+		q.fire(events)
+		q.Lock()
+	}
+
+	q.firing = false
+	q.Unlock()
+}
+
+// fire calls the hooks with the events. If a hook panics, the next operation
+// of the queue fires the events left.
+func (q *Queue) fire(events []mq.Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			q.Lock()
+			q.firing = false
+			q.Unlock()
+			panic(r)
+		}
+	}()
+
+	q.b.hooks.Fire(events...)
+}
+
+// logPublish logs the result of a publication. Must be called with the queue
+// lock held.
+func (q *Queue) logPublish(j *mq.Job, duplicate bool, err error) {
+	switch {
+	case err != nil:
+		f := q.fields(j)
+		f[mq.ErrorField] = err
+		q.queueLog(warnLevel, "publish failed", f)
+	case duplicate:
+		q.queueLog(debugLevel, "duplicate job dropped", q.fields(j))
+	}
+}
+
+// Publish publishes a Job to the queue. The job is dropped if it is a
+// duplicate, see SetDedupWindow.
 func (q *Queue) Publish(j *mq.Job) error {
+	_, err := q.PublishDedup(j)
+	return err
+}
+
+// PublishDedup implements the mq.Deduplicator interface.
+func (q *Queue) PublishDedup(j *mq.Job) (bool, error) {
+	defer q.flush()
 	if j == nil || j.Size() == 0 {
-		return mq.ErrEmptyJob.New()
+		err := mq.ErrEmptyJob.New()
+		q.Lock()
+		q.logPublish(j, false, err)
+		q.emit(mq.Event{Job: j, Transition: mq.Published, Err: err})
+		q.Unlock()
+		return false, err
 	}
 
 	q.Lock()
 	defer q.Unlock()
+	if q.parent != nil {
+		if q.parent.duplicateInTx(j, q.jobs) {
+			q.logPublish(j, true, nil)
+			return true, nil
+		}
+
+		q.jobs = append(q.jobs, j)
+		return false, nil
+	}
+
+	duplicate, replace, err := q.check(j)
+	if duplicate || err != nil {
+		q.logPublish(j, duplicate, err)
+		if err != nil {
+			q.emit(mq.Event{Job: j, Transition: mq.Published, Err: err})
+		}
+
+		return duplicate, err
+	}
+
+	q.admit(j, replace)
 	q.jobs = append(q.jobs, j)
-	return nil
+	q.emit(mq.Event{Job: j, Transition: mq.Published})
+	return false, nil
 }
 
-// PublishDelayed publishes a Job to the queue with a given delay.
+// PublishDelayed publishes a Job to the queue with a given delay. Duplicates
+// and unique keys are checked at the time of the call.
 func (q *Queue) PublishDelayed(j *mq.Job, delay time.Duration) error {
-	if j == nil || j.Size() == 0 {
-		return mq.ErrEmptyJob.New()
+	if q.publishImmediately || j == nil || j.Size() == 0 {
+		return q.Publish(j)
 	}
 
-	if q.publishImmediately {
-		return q.Publish(j)
+	defer q.flush()
+	q.Lock()
+	defer q.Unlock()
+	duplicate, replace, err := q.check(j)
+	if duplicate || err != nil {
+		q.logPublish(j, duplicate, err)
+		if err != nil {
+			q.emit(mq.Event{Job: j, Transition: mq.Published, Delay: delay, Err: err})
+		}
+
+		return err
 	}
-	go func() {
-		time.Sleep(delay)
-		q.Publish(j)
-	}()
+
+	q.admit(j, replace)
+	q.emit(mq.Event{Job: j, Transition: mq.Published, Delay: delay})
+
+	if q.delayed == nil {
+		q.delayed = make(map[*mq.Job]*time.Timer)
+	}
+
+	q.delayed[j] = time.AfterFunc(delay, func() {
+		defer q.flush()
+		q.Lock()
+		defer q.Unlock()
+		if _, ok := q.delayed[j]; ok {
+			delete(q.delayed, j)
+			q.jobs = append(q.jobs, j)
+			q.queueLog(debugLevel, "delayed job ready", q.fields(j))
+		}
+	})
+
+	return nil
+}
+
+// check checks whether the job can be published, without changing the queue.
+// It returns true if the job is a duplicate, or an error if its unique key is
+// taken; replace tells whether the pending job holding the unique key must be
+// replaced by the job. Must be called with the queue lock held.
+func (q *Queue) check(j *mq.Job) (duplicate, replace bool, err error) {
+	if q.duplicate(j) {
+		return true, false, nil
+	}
+
+	if j.UniqueKey == "" || !q.unique[j.UniqueKey] {
+		return false, false, nil
+	}
+
+	if q.uniquePolicy == mq.UniqueReplace && q.pending(j.UniqueKey) != nil {
+		return false, true, nil
+	}
+
+	return false, false, mq.ErrUniqueConflict.New(j.UniqueKey)
+}
+
+// admit takes the dedup and unique keys of a job accepted by check, removing
+// the pending job it replaces, if any. Must be called with the queue lock
+// held.
+func (q *Queue) admit(j *mq.Job, replace bool) {
+	if replace {
+		q.removePending(j.UniqueKey)
+	}
+
+	q.takeUnique(j.UniqueKey)
+	q.remember(j)
+}
+
+// SetDedupWindow sets the period of time in which a job published with the
+// same dedup key as a previous one is considered a duplicate and dropped. Use
+// 0, the default, to disable deduplication.
+func (q *Queue) SetDedupWindow(d time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	q.dedupWindow = d
+	if q.seen == nil {
+		q.seen = make(map[string]time.Time)
+	}
+}
+
+// duplicate returns true if a job with the same dedup key was published within
+// the dedup window. Must be called with the queue lock held.
+func (q *Queue) duplicate(j *mq.Job) bool {
+	if q.dedupWindow <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	for len(q.seenOrder) > 0 {
+		k := q.seenOrder[0]
+		if now.Sub(k.published) < q.dedupWindow {
+			break
+		}
+
+		// the key could have been published again
+		if q.seen[k.key].Equal(k.published) {
+			delete(q.seen, k.key)
+		}
+
+		q.seenOrder = q.seenOrder[1:]
+	}
+
+	_, ok := q.seen[j.DeduplicationKey()]
+	return ok
+}
+
+// duplicateInTx returns true if the job is a duplicate of a job published to
+// the queue within the dedup window, or of one of the jobs already published
+// in a transaction.
+func (q *Queue) duplicateInTx(j *mq.Job, tx []*mq.Job) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.dedupWindow <= 0 {
+		return false
+	}
+
+	if q.duplicate(j) {
+		return true
+	}
+
+	key := j.DeduplicationKey()
+	for _, published := range tx {
+		if published.DeduplicationKey() == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remember records the dedup key of a published job. Must be called with the
+// queue lock held.
+func (q *Queue) remember(j *mq.Job) {
+	if q.dedupWindow <= 0 {
+		return
+	}
+
+	k := seenKey{key: j.DeduplicationKey(), published: time.Now()}
+	q.seen[k.key] = k.published
+	q.seenOrder = append(q.seenOrder, k)
+}
+
+type seenKey struct {
+	key       string
+	published time.Time
+}
+
+// SetUniquePolicy sets what happens when a job is published while another job
+// with the same unique key is ready, delayed or leased, see mq.UniquePolicy.
+func (q *Queue) SetUniquePolicy(p mq.UniquePolicy) {
+	q.Lock()
+	defer q.Unlock()
+	q.uniquePolicy = p
+}
+
+func (q *Queue) takeUnique(key string) {
+	if key == "" {
+		return
+	}
+
+	if q.unique == nil {
+		q.unique = make(map[string]bool)
+	}
+
+	q.unique[key] = true
+}
+
+// unlockUnique releases the unique key of the job. Must be called with the
+// queue lock held.
+func (q *Queue) unlockUnique(j *mq.Job) {
+	if j.UniqueKey != "" {
+		delete(q.unique, j.UniqueKey)
+	}
+}
+
+// pending returns the ready or delayed job with the given unique key, or nil
+// if there is none. Must be called with the queue lock held.
+func (q *Queue) pending(key string) *mq.Job {
+	for _, j := range q.jobs {
+		if j.UniqueKey == key {
+			return j
+		}
+	}
+
+	for j := range q.delayed {
+		if j.UniqueKey == key {
+			return j
+		}
+	}
+
 	return nil
 }
 
+// removePending removes the ready or delayed job with the given unique key.
+// Must be called with the queue lock held.
+func (q *Queue) removePending(key string) {
+	for i, j := range q.jobs {
+		if j.UniqueKey == key {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			q.emit(mq.Event{Job: j, Transition: mq.Canceled})
+			return
+		}
+	}
+
+	for j, timer := range q.delayed {
+		if j.UniqueKey == key {
+			timer.Stop()
+			delete(q.delayed, j)
+			q.emit(mq.Event{Job: j, Transition: mq.Canceled})
+			return
+		}
+	}
+}
+
 // RepublishBuried implements the Queue interface.
 func (q *Queue) RepublishBuried(conditions ...mq.RepublishConditionFunc) error {
+	defer q.flush()
+	q.Lock()
+	defer q.Unlock()
+
+	var buried []*mq.Job
 	for _, job := range q.buriedJobs {
 		if mq.RepublishConditions(conditions).Comply(job) {
 			job.ErrorType = ""
-			if err := q.Publish(job); err != nil {
-				return err
-			}
+			q.takeUnique(job.UniqueKey)
+			q.jobs = append(q.jobs, job)
+			q.emit(mq.Event{Job: job, Transition: mq.Published})
+		} else {
+			buried = append(buried, job)
+		}
+	}
+
+	q.buriedJobs = buried
+	return nil
+}
+
+// Cancel implements the mq.Canceler interface. The buried jobs canceled don't
+// fire the mq.Canceled event, they were already finished.
+func (q *Queue) Cancel(id string) (bool, error) {
+	defer q.flush()
+	q.Lock()
+	defer q.Unlock()
+
+	if q.cancel(id) {
+		q.queueLog(infoLevel, "job canceled", q.fields(&mq.Job{ID: id}))
+		return true, nil
+	}
+
+	if q.leased[id] > 0 {
+		if q.canceled == nil {
+			q.canceled = make(map[string]bool)
+		}
+
+		q.canceled[id] = true
+		q.queueLog(infoLevel, "job canceled, it will be discarded once settled",
+			q.fields(&mq.Job{ID: id}))
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// cancel removes the ready, delayed or buried job with the given ID, it
+// returns false if there is none. Must be called with the queue lock held.
+func (q *Queue) cancel(id string) bool {
+	for idx, j := range q.jobs {
+		if j.ID == id {
+			q.jobs = append(q.jobs[:idx], q.jobs[idx+1:]...)
+			q.unlockUnique(j)
+			q.emit(mq.Event{Job: j, Transition: mq.Canceled})
+			return true
+		}
+	}
+
+	for j, timer := range q.delayed {
+		if j.ID == id {
+			timer.Stop()
+			delete(q.delayed, j)
+			q.unlockUnique(j)
+			q.emit(mq.Event{Job: j, Transition: mq.Canceled})
+			return true
+		}
+	}
+
+	for idx, j := range q.buriedJobs {
+		if j.ID == id {
+			q.buriedJobs = append(q.buriedJobs[:idx], q.buriedJobs[idx+1:]...)
+			return true
 		}
 	}
+
+	return false
+}
+
+// Stats implements the mq.Inspector interface.
+func (q *Queue) Stats() (mq.QueueStats, error) {
+	q.RLock()
+	defer q.RUnlock()
+	return mq.QueueStats{
+		Ready:    len(q.jobs),
+		Delayed:  len(q.delayed),
+		InFlight: q.inFlight,
+		Buried:   len(q.buriedJobs),
+	}, nil
+}
+
+// SetDeadLetter implements the mq.DeadLetterer interface. The dead-letter
+// queue is a regular queue of the same Broker, created if it does not exist.
+func (q *Queue) SetDeadLetter(p mq.DeadLetterPolicy) error {
+	if p.Queue == q.name {
+		return mq.ErrInvalidDeadLetter.New(p.Queue)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	q.deadLetter = p
 	return nil
 }
 
-// Transaction calls the given callback inside a transaction.
+// deadLetter is a job to be published to a dead-letter queue.
+type deadLetter struct {
+	// queue is the dead-letter queue, taken from the policy when the job
+	// was buried.
+	queue string
+	job   *mq.Job
+	// buried is the job buried instead if it can't be published.
+	buried *mq.Job
+}
+
+// bury sends a rejected job to the dead-letter queue if there is one, or to
+// the buried queue otherwise. It returns the job to be published to the
+// dead-letter queue, which must be done without the queue lock held.
+func (q *Queue) bury(j *mq.Job, reason string) *deadLetter {
+	q.unlockUnique(j)
+	e := mq.Event{Job: j, Transition: mq.Buried}
+	if reason == mq.DeadLetterExpired {
+		e.Err = mq.ErrLeaseExpired.New()
+	}
+
+	q.emit(e)
+	f := q.fields(j)
+	f[mq.ReasonField] = reason
+	if q.deadLetter.Queue == "" || q.b == nil {
+		q.buriedJobs = append(q.buriedJobs, j)
+		q.queueLog(infoLevel, "job buried", f)
+		return nil
+	}
+
+	f[mq.DeadLetterQueueField] = q.deadLetter.Queue
+	q.queueLog(infoLevel, "job sent to the dead-letter queue", f)
+
+	// the deliveries are counted again in the dead-letter queue, and the keys
+	// of the origin queue don't apply there
+	dead := *j
+	dead.Acknowledger = nil
+	dead.DedupKey = ""
+	dead.UniqueKey = ""
+	dead.Deliveries = 0
+	dead.Redelivered = false
+	dead.FirstDelivery = time.Time{}
+	dead.LastDelivery = time.Time{}
+	dead.DeadLetterOrigin = q.name
+	dead.DeadLetterReason = reason
+	return &deadLetter{queue: q.deadLetter.Queue, job: &dead, buried: j}
+}
+
+// publishDeadLetter publishes the given jobs to their dead-letter queue. The
+// jobs that can't be published, or that the dead-letter queue drops as
+// duplicates, are buried instead, so they are not lost. It returns the first
+// error.
+func (q *Queue) publishDeadLetter(dead ...*deadLetter) error {
+	var first error
+	for _, d := range dead {
+		if d == nil {
+			continue
+		}
+
+		duplicate, err := q.b.queue(d.queue).PublishDedup(d.job)
+		if err == nil && !duplicate {
+			continue
+		}
+
+		q.Lock()
+		q.buriedJobs = append(q.buriedJobs, d.buried)
+		q.Unlock()
+
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Transaction calls the given callback inside a transaction. The duplicates
+// are detected when they are published in the transaction, and reported by
+// mq.PublishDedup. The rest of checks happen when the transaction is
+// committed: if the unique key of any of the jobs is taken, nothing is
+// published. Under UniqueReplace, a job replaces the pending job with the
+// same unique key, including the previous jobs of the transaction. The jobs
+// that became duplicates while the transaction was open, because the same
+// dedup key was published meanwhile outside of it, are dropped on commit.
 func (q *Queue) Transaction(txcb mq.TxCallback) error {
-	txQ := &Queue{jobs: make([]*mq.Job, 0, 10), publishImmediately: true}
+	txQ := &Queue{jobs: make([]*mq.Job, 0, 10), parent: q, publishImmediately: true}
 	if err := txcb(txQ); err != nil {
 		return err
 	}
 
-	q.jobs = append(q.jobs, txQ.jobs...)
+	defer q.flush()
+	q.Lock()
+	defer q.Unlock()
+
+	var admitted []*mq.Job
+	// replace holds the unique keys whose pending job is replaced, unique
+	// the index of the jobs of the transaction holding them and dedup the
+	// dedup keys of the transaction.
+	replace := make(map[string]bool)
+	unique := make(map[string]int)
+	dedup := make(map[string]bool)
+	for _, j := range txQ.jobs {
+		duplicate, replaces, err := q.check(j)
+		if !duplicate && q.dedupWindow > 0 {
+			duplicate = dedup[j.DeduplicationKey()]
+		}
+
+		if duplicate {
+			q.logPublish(j, true, nil)
+			continue
+		}
+
+		if i, ok := unique[j.UniqueKey]; ok && j.UniqueKey != "" {
+			if q.uniquePolicy != mq.UniqueReplace {
+				err = mq.ErrUniqueConflict.New(j.UniqueKey)
+			} else {
+				admitted[i] = nil
+			}
+		}
+
+		if err != nil {
+			q.emit(mq.Event{Job: j, Transition: mq.Published, Err: err})
+			return err
+		}
+
+		replace[j.UniqueKey] = replace[j.UniqueKey] || replaces
+		unique[j.UniqueKey] = len(admitted)
+		dedup[j.DeduplicationKey()] = true
+		admitted = append(admitted, j)
+	}
+
+	for _, j := range admitted {
+		if j == nil {
+			continue
+		}
+
+		q.admit(j, replace[j.UniqueKey])
+		q.jobs = append(q.jobs, j)
+		q.emit(mq.Event{Job: j, Transition: mq.Published})
+	}
+
 	return nil
 }
 
 // Consume implements Queue. The advertisedWindow value is the maximum number of
 // unacknowledged jobs. Use 0 for an infinite window.
 func (q *Queue) Consume(advertisedWindow int) (mq.JobIter, error) {
+	return q.ConsumeWithVisibility(advertisedWindow, 0)
+}
+
+// ConsumeWithVisibility works like Consume, but every job returned by the
+// JobIter is leased for the given visibility timeout. If the job is not
+// acknowledged before the lease expires, it is put back in the queue to be
+// delivered again. Use 0 for leases that never expire.
+func (q *Queue) ConsumeWithVisibility(advertisedWindow int, timeout time.Duration) (mq.JobIter, error) {
 	jobIter := JobIter{
 		q:       q,
 		RWMutex: &q.RWMutex,
 		finite:  q.finite,
+		timeout: timeout,
+		leases:  make(map[*Acknowledger]struct{}),
+		quit:    make(chan struct{}),
 	}
 
 	if advertisedWindow > 0 {
@@ -135,101 +872,365 @@ func (q *Queue) Consume(advertisedWindow int) (mq.JobIter, error) {
 
 // JobIter implements a queue.JobIter interface.
 type JobIter struct {
-	q      *Queue
-	closed bool
-	finite bool
-	chn    chan struct{}
+	q       *Queue
+	closed  bool
+	finite  bool
+	timeout time.Duration
+	leases  map[*Acknowledger]struct{}
+	chn     chan struct{}
+	quit    chan struct{}
 	*sync.RWMutex
 }
 
+type leaseState int
+
+const (
+	leaseActive leaseState = iota
+	leaseSettled
+	leaseExpired
+)
+
 // Acknowledger implements a queue.Acknowledger interface.
 type Acknowledger struct {
-	q   *Queue
-	j   *mq.Job
-	chn chan struct{}
+	q        *Queue
+	j        *mq.Job
+	iter     *JobIter
+	timer    *time.Timer
+	deadline time.Time
+	state    leaseState
 }
 
-// Ack is called when the Job has finished.
+// Ack is called when the Job has finished. It returns mq.ErrLeaseExpired if
+// the job was already put back in the queue, and does nothing if the job was
+// already acknowledged or rejected.
 func (a *Acknowledger) Ack() error {
-	a.release()
+	defer a.q.flush()
+	a.q.Lock()
+	defer a.q.Unlock()
+	if a.state == leaseSettled {
+		return nil
+	}
+
+	if err := a.settle(); err != nil {
+		a.q.emit(mq.Event{Job: a.j, Transition: mq.Acked, Err: err})
+		return err
+	}
+
+	a.q.unlockUnique(a.j)
+	a.q.emit(mq.Event{Job: a.j, Transition: mq.Acked})
 	return nil
 }
 
 // Reject is called when the Job has errored. The argument indicates whether the Job
-// should be put back in queue or not.  If requeue is false, the job will go to the buried
-// queue until Queue.RepublishBuried() is called.
+// should be put back in queue or not.  If requeue is false, the job will go to the
+// dead-letter queue if the queue has one, or to the buried queue until
+// Queue.RepublishBuried() is called.
 func (a *Acknowledger) Reject(requeue bool) error {
-	defer a.release()
+	dead, err := a.reject(requeue)
+	if err != nil || dead == nil {
+		return err
+	}
+
+	return a.q.publishDeadLetter(dead)
+}
+
+func (a *Acknowledger) reject(requeue bool) (*deadLetter, error) {
+	defer a.q.flush()
+	a.q.Lock()
+	defer a.q.Unlock()
+
+	if a.state == leaseSettled {
+		return nil, nil
+	}
+
+	canceled := a.q.canceled[a.j.ID]
+	e := mq.Event{Job: a.j, Transition: mq.Rejected, Requeue: requeue}
+	if err := a.settle(); err != nil {
+		e.Err = err
+		a.q.emit(e)
+		return nil, err
+	}
+
+	a.q.emit(e)
+	if canceled {
+		a.q.unlockUnique(a.j)
+		a.q.emit(mq.Event{Job: a.j, Transition: mq.Canceled})
+		return nil, nil
+	}
+
+	f := a.q.fields(a.j)
+	f[mq.RequeueField] = requeue
+	a.q.queueLog(infoLevel, "job rejected", f)
 
 	if !requeue {
-		// Send to the buried queue for later republishing
-		a.q.buriedJobs = append(a.q.buriedJobs, a.j)
+		return a.q.bury(a.j, mq.DeadLetterRejected), nil
+	}
+
+	a.q.requeue(a.j)
+	return nil, nil
+}
+
+// Extend implements the mq.Extender interface. It returns
+// mq.ErrLeaseExpired if the job was already put back in the queue.
+func (a *Acknowledger) Extend(d time.Duration) error {
+	a.q.Lock()
+	defer a.q.Unlock()
+
+	if a.state != leaseActive {
+		return mq.ErrLeaseExpired.New()
+	}
+
+	if a.timer != nil {
+		a.deadline = time.Now().Add(d)
+		a.timer.Reset(d)
+	}
+
+	return nil
+}
+
+// settle ends the lease of an acknowledged job. Must be called with the
+// queue lock held.
+func (a *Acknowledger) settle() error {
+	switch a.state {
+	case leaseSettled:
 		return nil
+	case leaseExpired:
+		return mq.ErrLeaseExpired.New()
 	}
 
-	return a.q.Publish(a.j)
+	a.state = leaseSettled
+	a.release()
+	return nil
 }
 
-func (a *Acknowledger) release() {
-	if a.chn != nil {
-		<-a.chn
+// expire puts the job back in the queue if its lease is still active, or
+// sends it to the dead-letter queue if it was delivered too many times.
+func (a *Acknowledger) expire() {
+	a.q.Lock()
+	// the lease could have been extended while the timer was firing
+	if time.Now().Before(a.deadline) {
+		a.q.Unlock()
+		return
+	}
+
+	if a.state == leaseActive {
+		f := a.q.fields(a.j)
+		f[mq.DeliveriesField] = a.j.Deliveries
+		a.q.queueLog(warnLevel, "job lease expired", f)
+	}
+
+	dead := a.requeue()
+	a.q.Unlock()
+	a.q.flush()
+
+	if err := a.q.publishDeadLetter(dead); err != nil {
+		f := a.q.fields(a.j)
+		f[mq.ErrorField] = err
+		a.q.log().Error("job buried, it could not be sent to the dead-letter queue", f)
 	}
 }
 
-func (i *JobIter) isClosed() bool {
-	i.RLock()
-	defer i.RUnlock()
-	return i.closed
+// requeue puts back the job of an active lease in the queue. Must be called
+// with the queue lock held. It returns the job to be published to the
+// dead-letter queue, if any.
+func (a *Acknowledger) requeue() *deadLetter {
+	if a.state != leaseActive {
+		return nil
+	}
+
+	canceled := a.q.canceled[a.j.ID]
+	a.state = leaseExpired
+	a.release()
+
+	e := mq.Event{Job: a.j, Transition: mq.Rejected, Err: mq.ErrLeaseExpired.New()}
+	if canceled {
+		a.q.emit(e)
+		a.q.unlockUnique(a.j)
+		a.q.emit(mq.Event{Job: a.j, Transition: mq.Canceled})
+		return nil
+	}
+
+	max := a.q.deadLetter.MaxDeliveries
+	if max > 0 && a.j.Deliveries >= max {
+		a.q.emit(e)
+		return a.q.bury(a.j, mq.DeadLetterExpired)
+	}
+
+	e.Requeue = true
+	a.q.emit(e)
+	a.q.requeue(a.j)
+	return nil
+}
+
+func (a *Acknowledger) release() {
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+
+	if a.j.GroupKey != "" {
+		delete(a.q.groups, a.j.GroupKey)
+	}
+
+	a.q.inFlight--
+	if a.q.leased[a.j.ID]--; a.q.leased[a.j.ID] <= 0 {
+		delete(a.q.leased, a.j.ID)
+		delete(a.q.canceled, a.j.ID)
+	}
+
+	delete(a.iter.leases, a)
+	a.iter.release()
 }
 
 // Next returns the next job in the iter.
 func (i *JobIter) Next() (*mq.Job, error) {
-	i.acquire()
-	for {
-		if i.isClosed() {
-			i.release()
-			return nil, mq.ErrAlreadyClosed.New()
-		}
+	if !i.acquire() {
+		return nil, mq.ErrAlreadyClosed.New()
+	}
 
+	for {
 		j, err := i.next()
 		if err == nil {
 			return j, nil
 		}
 
-		if err == io.EOF && i.finite {
+		if mq.ErrAlreadyClosed.Is(err) || (err == io.EOF && i.finite) {
 			i.release()
 			return nil, err
 		}
 
-		time.Sleep(1 * time.Second)
+		select {
+		case <-time.After(1 * time.Second):
+		case <-i.quit:
+		}
 	}
 }
 
 func (i *JobIter) next() (*mq.Job, error) {
+	defer i.q.flush()
 	i.Lock()
 	defer i.Unlock()
-	if len(i.q.jobs) <= i.q.idx {
+	if i.closed {
+		return nil, mq.ErrAlreadyClosed.New()
+	}
+
+	if len(i.q.jobs) == 0 {
 		return nil, io.EOF
 	}
 
-	j := i.q.jobs[i.q.idx]
-	j.Acknowledger = &Acknowledger{j: j, q: i.q, chn: i.chn}
-	i.q.idx++
+	stored := i.q.take()
+	if stored == nil {
+		return nil, errGroupsBusy
+	}
+
+	j := *stored
+	j.Deliveries++
+	j.Redelivered = j.Deliveries > 1
+	j.LastDelivery = time.Now()
+	if j.FirstDelivery.IsZero() {
+		j.FirstDelivery = j.LastDelivery
+	}
+
+	a := &Acknowledger{j: &j, q: i.q, iter: i}
+	if i.timeout > 0 {
+		a.deadline = time.Now().Add(i.timeout)
+		a.timer = time.AfterFunc(i.timeout, a.expire)
+	}
+
+	i.q.inFlight++
+	if i.q.leased == nil {
+		i.q.leased = make(map[string]int)
+	}
+
+	i.q.leased[j.ID]++
+	i.leases[a] = struct{}{}
+	j.Acknowledger = a
+	i.q.emit(mq.Event{Job: &j, Transition: mq.Delivered})
+	return &j, nil
+}
+
+// take removes from the queue the first ready job whose group has no job in
+// flight, marking its group as in flight. It returns nil if there is none.
+// Must be called with the queue lock held.
+func (q *Queue) take() *mq.Job {
+	for idx, j := range q.jobs {
+		if j.GroupKey != "" && q.groups[j.GroupKey] {
+			continue
+		}
+
+		if j.GroupKey != "" {
+			if q.groups == nil {
+				q.groups = make(map[string]bool)
+			}
+
+			q.groups[j.GroupKey] = true
+		}
+
+		copy(q.jobs[idx:], q.jobs[idx+1:])
+		q.jobs[len(q.jobs)-1] = nil
+		q.jobs = q.jobs[:len(q.jobs)-1]
+		return j
+	}
+
+	return nil
+}
+
+// requeue puts back in the queue a job that was delivered. Jobs with a group
+// key go first, so they are delivered again before the rest of the jobs of
+// their group. Must be called with the queue lock held.
+func (q *Queue) requeue(j *mq.Job) {
+	if j.GroupKey == "" {
+		q.jobs = append(q.jobs, j)
+		return
+	}
 
-	return j, nil
+	q.jobs = append([]*mq.Job{j}, q.jobs...)
 }
 
-// Close closes the iter.
+// Close closes the iter. The jobs returned by the iter that were not
+// acknowledged yet are put back in the queue.
 func (i *JobIter) Close() error {
 	i.Lock()
-	defer i.Unlock()
+	if i.closed {
+		i.Unlock()
+		return nil
+	}
+
 	i.closed = true
+	close(i.quit)
+
+	var dead []*deadLetter
+	for a := range i.leases {
+		dead = append(dead, a.requeue())
+	}
+
+	f := i.q.fields(nil)
+	f[mq.UnackedField] = len(dead)
+	i.q.queueLog(debugLevel, "iterator closed", f)
+
+	i.Unlock()
+	i.q.flush()
+	if err := i.q.publishDeadLetter(dead...); err != nil {
+		f := i.q.fields(nil)
+		f[mq.ErrorField] = err
+		i.q.log().Error("jobs buried, they could not be sent to the dead-letter queue", f)
+		return err
+	}
+
 	return nil
 }
 
-func (i *JobIter) acquire() {
-	if i.chn != nil {
-		i.chn <- struct{}{}
+// acquire blocks until there is room in the advertised window, it returns
+// false if the iter is closed while waiting.
+func (i *JobIter) acquire() bool {
+	if i.chn == nil {
+		return true
+	}
+
+	select {
+	case i.chn <- struct{}{}:
+		return true
+	case <-i.quit:
+		return false
 	}
 }
 
@@ -1,12 +1,16 @@
 package memory
 
 import (
+	"fmt"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/go-mq/mq/v2"
 	"github.com/go-mq/mq/v2/test"
 
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -15,6 +19,10 @@ func TestMemorySuite(t *testing.T) {
 	suite.Run(t, new(MemorySuite))
 }
 
+func TestMemoryTopicSuite(t *testing.T) {
+	suite.Run(t, &test.TopicSuite{BrokerURI: "memory://"})
+}
+
 type MemorySuite struct {
 	test.QueueSuite
 }
@@ -94,3 +102,628 @@ func (s *MemorySuite) TestFinite() {
 	assert.Equal(io.EOF, err)
 	assert.Nil(retrievedJob)
 }
+
+func (s *MemorySuite) TestVisibilityTimeout() {
+	assert := assert.New(s.T())
+
+	q, err := s.Broker.Queue(test.NewName())
+	assert.NoError(err)
+
+	j := mq.NewJob()
+	assert.NoError(j.Encode(true))
+	assert.NoError(q.Publish(j))
+
+	iter, err := q.(*Queue).ConsumeWithVisibility(1, 50*time.Millisecond)
+	assert.NoError(err)
+	defer iter.Close()
+
+	expired, err := iter.Next()
+	assert.NoError(err)
+	assert.EqualValues(1, expired.Deliveries)
+
+	// the lease expires and the job is delivered again
+	redelivered, err := iter.Next()
+	assert.NoError(err)
+	assert.Equal(j.ID, redelivered.ID)
+	assert.EqualValues(2, redelivered.Deliveries)
+
+	assert.True(mq.ErrLeaseExpired.Is(expired.Ack()))
+	assert.NoError(redelivered.Ack())
+	assert.NoError(redelivered.Ack())
+}
+
+func (s *MemorySuite) TestDeadLetter_expired() {
+	assert := assert.New(s.T())
+
+	q, err := s.Broker.Queue(test.NewName())
+	assert.NoError(err)
+
+	dlqName := test.NewName()
+	assert.NoError(q.(mq.DeadLetterer).SetDeadLetter(mq.DeadLetterPolicy{
+		Queue:         dlqName,
+		MaxDeliveries: 2,
+	}))
+
+	j := mq.NewJob()
+	assert.NoError(j.Encode(true))
+	assert.NoError(q.Publish(j))
+
+	iter, err := q.(*Queue).ConsumeWithVisibility(0, 10*time.Millisecond)
+	assert.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		_, err := iter.Next()
+		assert.NoError(err)
+	}
+
+	dlq, err := s.Broker.Queue(dlqName)
+	assert.NoError(err)
+
+	dlqIter, err := dlq.Consume(0)
+	assert.NoError(err)
+
+	dead, err := dlqIter.Next()
+	assert.NoError(err)
+	assert.Equal(j.ID, dead.ID)
+	assert.EqualValues(1, dead.Deliveries)
+	assert.Equal(mq.DeadLetterExpired, dead.DeadLetterReason)
+	assert.NoError(dead.Ack())
+
+	assert.NoError(iter.Close())
+	assert.NoError(dlqIter.Close())
+	assert.True(mq.ErrInvalidDeadLetter.Is(
+		q.(mq.DeadLetterer).SetDeadLetter(mq.DeadLetterPolicy{Queue: q.(*Queue).name}),
+	))
+}
+
+func (s *MemorySuite) TestDeadLetter_keys() {
+	assert := assert.New(s.T())
+
+	q, err := s.Broker.Queue(test.NewName())
+	assert.NoError(err)
+	q.(*Queue).SetDedupWindow(time.Minute)
+
+	dlqName := test.NewName()
+	assert.NoError(q.(mq.DeadLetterer).SetDeadLetter(mq.DeadLetterPolicy{Queue: dlqName}))
+
+	dlq, err := s.Broker.Queue(dlqName)
+	assert.NoError(err)
+	dlq.(*Queue).SetDedupWindow(time.Minute)
+
+	iter, err := q.Consume(0)
+	assert.NoError(err)
+	defer iter.Close()
+
+	// the keys of the origin queue are not kept in the dead-letter queue, so
+	// a second job with the same keys is not dropped there
+	for i := 0; i < 2; i++ {
+		j := mq.NewJob()
+		j.UniqueKey = "report"
+		j.DedupKey = fmt.Sprintf("report-%d", i)
+		assert.NoError(j.Encode(i))
+		assert.NoError(q.Publish(j))
+
+		j, err = iter.Next()
+		assert.NoError(err)
+		assert.NoError(j.Reject(false))
+	}
+
+	stats, err := dlq.(mq.Inspector).Stats()
+	assert.NoError(err)
+	assert.Equal(mq.QueueStats{Ready: 2}, stats)
+
+	dlqIter, err := dlq.Consume(0)
+	assert.NoError(err)
+	defer dlqIter.Close()
+
+	dead, err := dlqIter.Next()
+	assert.NoError(err)
+	assert.Empty(dead.UniqueKey)
+	assert.Empty(dead.DedupKey)
+}
+
+func (s *MemorySuite) TestDeadLetter_duplicate() {
+	assert := assert.New(s.T())
+
+	q, err := s.Broker.Queue(test.NewName())
+	assert.NoError(err)
+
+	dlqName := test.NewName()
+	assert.NoError(q.(mq.DeadLetterer).SetDeadLetter(mq.DeadLetterPolicy{Queue: dlqName}))
+
+	dlq, err := s.Broker.Queue(dlqName)
+	assert.NoError(err)
+	dlq.(*Queue).SetDedupWindow(time.Minute)
+
+	j := mq.NewJob()
+	assert.NoError(j.Encode(true))
+	dup := *j
+	assert.NoError(dlq.Publish(&dup))
+	assert.NoError(q.Publish(j))
+
+	iter, err := q.Consume(0)
+	assert.NoError(err)
+	defer iter.Close()
+
+	j, err = iter.Next()
+	assert.NoError(err)
+
+	// the dead-letter queue drops the job as a duplicate, so it's buried in
+	// its queue instead of lost
+	assert.NoError(j.Reject(false))
+
+	stats, err := q.(mq.Inspector).Stats()
+	assert.NoError(err)
+	assert.Equal(mq.QueueStats{Buried: 1}, stats)
+
+	stats, err = dlq.(mq.Inspector).Stats()
+	assert.NoError(err)
+	assert.Equal(mq.QueueStats{Ready: 1}, stats)
+}
+
+func (s *MemorySuite) TestPublishDedup() {
+	assert := assert.New(s.T())
+
+	q, err := s.Broker.Queue(test.NewName())
+	assert.NoError(err)
+	q.(*Queue).SetDedupWindow(50 * time.Millisecond)
+
+	j := mq.NewJob()
+	assert.NoError(j.Encode(true))
+
+	duplicate, err := mq.PublishDedup(q, j)
+	assert.NoError(err)
+	assert.False(duplicate)
+
+	duplicate, err = mq.PublishDedup(q, j)
+	assert.NoError(err)
+	assert.True(duplicate)
+	assert.NoError(q.PublishDelayed(j, time.Millisecond))
+	assert.NoError(q.Transaction(func(tx mq.Queue) error {
+		duplicate, err := mq.PublishDedup(tx, j)
+		assert.True(duplicate)
+		return err
+	}))
+
+	// the duplicates of a transaction are reported too
+	other := mq.NewJob()
+	assert.NoError(other.Encode(true))
+	assert.NoError(q.Transaction(func(tx mq.Queue) error {
+		duplicate, err := mq.PublishDedup(tx, other)
+		assert.False(duplicate)
+		assert.NoError(err)
+
+		duplicate, err = mq.PublishDedup(tx, other)
+		assert.True(duplicate)
+		return err
+	}))
+
+	time.Sleep(60 * time.Millisecond)
+	duplicate, err = mq.PublishDedup(q, j)
+	assert.NoError(err)
+	assert.False(duplicate)
+
+	assert.Len(q.(*Queue).jobs, 3)
+}
+
+func (s *MemorySuite) TestUniqueKey_reject() {
+	assert := assert.New(s.T())
+
+	q, err := s.Broker.Queue(test.NewName())
+	assert.NoError(err)
+
+	newJob := func() *mq.Job {
+		j := mq.NewJob()
+		j.UniqueKey = "rebuild-cache"
+		assert.NoError(j.Encode(true))
+		return j
+	}
+
+	assert.NoError(q.Publish(newJob()))
+	assert.True(mq.ErrUniqueConflict.Is(q.Publish(newJob())))
+	assert.True(mq.ErrUniqueConflict.Is(q.PublishDelayed(newJob(), time.Second)))
+
+	iter, err := q.Consume(0)
+	assert.NoError(err)
+	defer iter.Close()
+
+	j, err := iter.Next()
+	assert.NoError(err)
+	assert.True(mq.ErrUniqueConflict.Is(q.Publish(newJob())))
+
+	// the key is kept while the job is requeued
+	assert.NoError(j.Reject(true))
+	assert.True(mq.ErrUniqueConflict.Is(q.Publish(newJob())))
+
+	j, err = iter.Next()
+	assert.NoError(err)
+	assert.NoError(j.Ack())
+	assert.NoError(q.Publish(newJob()))
+
+	// and released when the job is buried
+	j, err = iter.Next()
+	assert.NoError(err)
+	assert.NoError(j.Reject(false))
+	assert.NoError(q.Publish(newJob()))
+}
+
+func (s *MemorySuite) TestUniqueKey_replace() {
+	assert := assert.New(s.T())
+
+	b, err := mq.NewBroker("memoryfinite://")
+	assert.NoError(err)
+
+	q, err := b.Queue(test.NewName())
+	assert.NoError(err)
+	q.(*Queue).SetUniquePolicy(mq.UniqueReplace)
+
+	newJob := func(payload int) *mq.Job {
+		j := mq.NewJob()
+		j.UniqueKey = "rebuild-cache"
+		assert.NoError(j.Encode(payload))
+		return j
+	}
+
+	assert.NoError(q.Publish(newJob(1)))
+	assert.NoError(q.PublishDelayed(newJob(2), time.Hour))
+	assert.NoError(q.Publish(newJob(3)))
+
+	iter, err := q.Consume(0)
+	assert.NoError(err)
+	defer iter.Close()
+
+	j, err := iter.Next()
+	assert.NoError(err)
+
+	var payload int
+	assert.NoError(j.Decode(&payload))
+	assert.Equal(3, payload)
+
+	// a running job can't be replaced
+	assert.True(mq.ErrUniqueConflict.Is(q.Publish(newJob(4))))
+	assert.NoError(j.Ack())
+
+	_, err = iter.Next()
+	assert.Equal(io.EOF, err)
+	assert.Empty(q.(*Queue).delayed)
+}
+
+func (s *MemorySuite) TestUniqueKey_replace_transaction() {
+	assert := assert.New(s.T())
+
+	b, err := mq.NewBroker("memoryfinite://")
+	assert.NoError(err)
+
+	q, err := b.Queue(test.NewName())
+	assert.NoError(err)
+	q.(*Queue).SetUniquePolicy(mq.UniqueReplace)
+	q.(*Queue).SetDedupWindow(time.Minute)
+
+	newJob := func(key string, payload int) *mq.Job {
+		j := mq.NewJob()
+		j.UniqueKey = key
+		assert.NoError(j.Encode(payload))
+		return j
+	}
+
+	assert.NoError(q.Publish(newJob("running", 0)))
+	iter, err := q.Consume(0)
+	assert.NoError(err)
+	defer iter.Close()
+
+	running, err := iter.Next()
+	assert.NoError(err)
+	assert.NoError(q.Publish(newJob("rebuild-cache", 1)))
+
+	// the pending job is kept if the transaction fails
+	replacement := newJob("rebuild-cache", 2)
+	err = q.Transaction(func(tx mq.Queue) error {
+		assert.NoError(tx.Publish(replacement))
+		return tx.Publish(newJob("running", 3))
+	})
+	assert.True(mq.ErrUniqueConflict.Is(err))
+	assert.NoError(running.Ack())
+
+	// and the keys of the jobs of the failed transaction are not taken
+	duplicate, err := mq.PublishDedup(q, replacement)
+	assert.NoError(err)
+	assert.False(duplicate)
+
+	duplicate, err = mq.PublishDedup(q, replacement)
+	assert.NoError(err)
+	assert.True(duplicate)
+
+	// the last job with the same key of a transaction wins
+	assert.NoError(q.Transaction(func(tx mq.Queue) error {
+		assert.NoError(tx.Publish(newJob("rebuild-cache", 4)))
+		return tx.Publish(newJob("rebuild-cache", 5))
+	}))
+
+	j, err := iter.Next()
+	assert.NoError(err)
+
+	var payload int
+	assert.NoError(j.Decode(&payload))
+	assert.Equal(5, payload)
+	assert.NoError(j.Ack())
+
+	_, err = iter.Next()
+	assert.Equal(io.EOF, err)
+}
+
+func (s *MemorySuite) TestGroupKey() {
+	assert := assert.New(s.T())
+
+	b, err := mq.NewBroker("memoryfinite://")
+	assert.NoError(err)
+
+	q, err := b.Queue(test.NewName())
+	assert.NoError(err)
+
+	for _, payload := range []string{"a1", "a2", "b1", "a3"} {
+		j := mq.NewJob()
+		j.GroupKey = payload[:1]
+		assert.NoError(j.Encode(payload))
+		assert.NoError(q.Publish(j))
+	}
+
+	iter, err := q.Consume(0)
+	assert.NoError(err)
+	defer iter.Close()
+
+	next := func() (*mq.Job, string) {
+		j, err := iter.Next()
+		assert.NoError(err)
+
+		var payload string
+		assert.NoError(j.Decode(&payload))
+		return j, payload
+	}
+
+	a1, payload := next()
+	assert.Equal("a1", payload)
+
+	// the rest of the group a waits for a1
+	b1, payload := next()
+	assert.Equal("b1", payload)
+	assert.NoError(b1.Ack())
+
+	// a1 is delivered again before the rest of its group
+	assert.NoError(a1.Reject(true))
+	a1, payload = next()
+	assert.Equal("a1", payload)
+
+	done := make(chan string)
+	go func() {
+		j, payload := next()
+		assert.NoError(j.Ack())
+		done <- payload
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(a1.Ack())
+	assert.Equal("a2", <-done)
+
+	_, payload = next()
+	assert.Equal("a3", payload)
+}
+
+func TestLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+
+	b := New()
+	assert.True(mq.SetLogger(b, mq.NewLogrusLogger(logger)))
+
+	q, err := b.Queue("logged")
+	assert.NoError(err)
+
+	// the logger is called without the queue lock held
+	logger.AddHook(&statsHook{q: q})
+
+	assert.Error(q.Publish(nil))
+	entry := hook.LastEntry()
+	assert.Equal(logrus.WarnLevel, entry.Level)
+	assert.Equal("publish failed", entry.Message)
+	assert.Equal("logged", entry.Data[mq.QueueField])
+	assert.NotNil(entry.Data[mq.ErrorField])
+
+	j := mq.NewJob()
+	assert.NoError(j.Encode(true))
+	assert.NoError(q.Publish(j))
+
+	iter, err := q.Consume(0)
+	assert.NoError(err)
+
+	j, err = iter.Next()
+	assert.NoError(err)
+
+	hook.Reset()
+	assert.NoError(j.Reject(false))
+	entries := hook.AllEntries()
+	assert.Len(entries, 2)
+	assert.Equal("job rejected", entries[0].Message)
+	assert.Equal(j.ID, entries[0].Data[mq.JobIDField])
+	assert.Equal(false, entries[0].Data[mq.RequeueField])
+	assert.Equal("job buried", entries[1].Message)
+	assert.Equal(mq.DeadLetterRejected, entries[1].Data[mq.ReasonField])
+
+	assert.NoError(iter.Close())
+	entry = hook.LastEntry()
+	assert.Equal(logrus.DebugLevel, entry.Level)
+	assert.Equal("iterator closed", entry.Message)
+	assert.Equal("logged", entry.Data[mq.QueueField])
+}
+
+// statsHook is a logrus hook using the queue.
+type statsHook struct {
+	q mq.Queue
+}
+
+func (h *statsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *statsHook) Fire(*logrus.Entry) error {
+	_, err := h.q.(mq.Inspector).Stats()
+	return err
+}
+
+func TestDeleteQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	logger, hook := logtest.NewNullLogger()
+	b := New()
+	assert.True(mq.SetLogger(b, mq.NewLogrusLogger(logger)))
+	q, err := b.Queue("deleted")
+	assert.NoError(err)
+
+	for _, delay := range []time.Duration{0, 10 * time.Millisecond} {
+		j := mq.NewJob()
+		assert.NoError(j.Encode(true))
+		if delay == 0 {
+			assert.NoError(q.Publish(j))
+		} else {
+			assert.NoError(q.PublishDelayed(j, delay))
+		}
+	}
+
+	assert.NoError(mq.DeleteQueue(b, "deleted"))
+	entry := hook.LastEntry()
+	assert.Equal("queue deleted", entry.Message)
+	assert.Equal("deleted", entry.Data[mq.QueueField])
+	assert.Equal(1, entry.Data[mq.ReadyField])
+	assert.Equal(1, entry.Data[mq.DelayedField])
+	assert.Equal(0, entry.Data[mq.BuriedField])
+
+	assert.NoError(mq.DeleteQueue(b, "deleted"))
+
+	time.Sleep(20 * time.Millisecond)
+	q, err = b.Queue("deleted")
+	assert.NoError(err)
+	stats, err := q.(mq.Inspector).Stats()
+	assert.NoError(err)
+	assert.Equal(mq.QueueStats{}, stats)
+}
+
+func TestSubscription_Unsubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	topic, err := New().(mq.TopicBroker).Topic("unsubscribed")
+	assert.NoError(err)
+	sub, err := topic.Subscribe("sub", true)
+	assert.NoError(err)
+
+	for _, delay := range []time.Duration{0, 10 * time.Millisecond} {
+		j := mq.NewJob()
+		assert.NoError(j.Encode(true))
+		assert.NoError(sub.PublishDelayed(j, delay))
+	}
+
+	// the pending jobs are dropped, and the delayed one never shows up
+	assert.NoError(sub.Unsubscribe())
+	time.Sleep(20 * time.Millisecond)
+	stats, err := sub.(mq.Inspector).Stats()
+	assert.NoError(err)
+	assert.Equal(mq.QueueStats{}, stats)
+}
+
+func TestTopic_Publish_failed(t *testing.T) {
+	assert := assert.New(t)
+
+	topic, err := New().(mq.TopicBroker).Topic("failed")
+	assert.NoError(err)
+
+	var subs []mq.Subscription
+	for _, name := range []string{"a", "b", "c"} {
+		sub, err := topic.Subscribe(name, true)
+		assert.NoError(err)
+		subs = append(subs, sub)
+	}
+
+	// the unique key is taken in one of the subscriptions only
+	taken := mq.NewJob()
+	taken.UniqueKey = "key"
+	assert.NoError(taken.Encode(true))
+	assert.NoError(subs[1].Publish(taken))
+
+	j := mq.NewJob()
+	j.UniqueKey = "key"
+	assert.NoError(j.Encode(true))
+	assert.True(mq.ErrUniqueConflict.Is(topic.Publish(j)))
+
+	// the rest of subscriptions got their copy anyway
+	for _, sub := range subs {
+		stats, err := sub.(mq.Inspector).Stats()
+		assert.NoError(err)
+		assert.Equal(1, stats.Ready)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	var canceled []string
+	b := mq.AddHook(New(), &mq.Hooks{
+		OnCancel: func(e mq.Event) { canceled = append(canceled, e.Job.ID) },
+	})
+
+	q, err := b.Queue("cancel")
+	assert.NoError(err)
+
+	publish := func(delay time.Duration) *mq.Job {
+		j := mq.NewJob()
+		j.UniqueKey = "key-" + j.ID
+		assert.NoError(j.Encode(true))
+		if delay > 0 {
+			assert.NoError(q.PublishDelayed(j, delay))
+		} else {
+			assert.NoError(q.Publish(j))
+		}
+
+		return j
+	}
+
+	buried := publish(0)
+	leased := publish(0)
+	ready := publish(0)
+	delayed := publish(time.Hour)
+
+	iter, err := q.Consume(0)
+	assert.NoError(err)
+	defer iter.Close()
+
+	j, err := iter.Next()
+	assert.NoError(err)
+	assert.Equal(buried.ID, j.ID)
+	assert.NoError(j.Reject(false))
+
+	leasedJob, err := iter.Next()
+	assert.NoError(err)
+	assert.Equal(leased.ID, leasedJob.ID)
+
+	for _, j := range []*mq.Job{buried, leased, ready, delayed} {
+		ok, err := mq.Cancel(q, j.ID)
+		assert.NoError(err)
+		assert.True(ok, j.ID)
+	}
+
+	ok, err := mq.Cancel(q, "unknown")
+	assert.NoError(err)
+	assert.False(ok)
+
+	// the canceled leased job is discarded instead of requeued
+	assert.NoError(leasedJob.Reject(true))
+	assert.Equal([]string{ready.ID, delayed.ID, leased.ID}, canceled)
+
+	stats, err := q.(mq.Inspector).Stats()
+	assert.NoError(err)
+	assert.Equal(mq.QueueStats{}, stats)
+
+	// the unique keys are released
+	for _, j := range []*mq.Job{leased, ready, delayed} {
+		assert.NoError(q.Publish(j))
+	}
+}
@@ -0,0 +1,118 @@
+package memory
+
+import (
+	"sync"
+
+	"github.com/go-mq/mq/v2"
+)
+
+// Topic returns the topic with the given name.
+func (b *Broker) Topic(name string) (mq.Topic, error) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.topics[name]; !ok {
+		b.topics[name] = &Topic{
+			name: name,
+			b:    b,
+			subs: make(map[string]*Subscription),
+		}
+	}
+
+	return b.topics[name], nil
+}
+
+// Topic implements the mq.Topic interface.
+type Topic struct {
+	name string
+	b    *Broker
+	subs map[string]*Subscription
+	sync.RWMutex
+}
+
+// Publish publishes a copy of the Job to every subscription of the topic. A
+// subscription failing does not stop the rest from getting their copy, the
+// first error is returned.
+func (t *Topic) Publish(j *mq.Job) error {
+	if j == nil || j.Size() == 0 {
+		return mq.ErrEmptyJob.New()
+	}
+
+	t.RLock()
+	defer t.RUnlock()
+	var first error
+	for _, s := range t.subs {
+		c := *j
+		c.Acknowledger = nil
+		if err := s.Publish(&c); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Subscribe returns the subscription with the given name, creating it if it
+// does not exist. It returns mq.ErrDurabilityMismatch if it exists with a
+// different durability.
+func (t *Topic) Subscribe(name string, durable bool) (mq.Subscription, error) {
+	t.Lock()
+	defer t.Unlock()
+	if sub, ok := t.subs[name]; ok {
+		if sub.durable != durable {
+			return nil, mq.ErrDurabilityMismatch.New(name)
+		}
+
+		return sub, nil
+	}
+
+	sub := &Subscription{
+		Queue:   t.b.newQueue(t.name + "." + name),
+		t:       t,
+		name:    name,
+		durable: durable,
+	}
+
+	t.subs[name] = sub
+	return sub, nil
+}
+
+// Subscription implements the mq.Subscription interface, its jobs are kept
+// in their own Queue.
+type Subscription struct {
+	*Queue
+	t       *Topic
+	name    string
+	durable bool
+}
+
+// Name returns the name of the subscription.
+func (s *Subscription) Name() string {
+	return s.name
+}
+
+// Durable returns true if the subscription survives being closed.
+func (s *Subscription) Durable() bool {
+	return s.durable
+}
+
+// Unsubscribe deletes the subscription from its topic, dropping its pending
+// jobs, including the delayed ones.
+func (s *Subscription) Unsubscribe() error {
+	s.t.Lock()
+	if s.t.subs[s.name] == s {
+		delete(s.t.subs, s.name)
+	}
+
+	s.t.Unlock()
+	s.drop()
+	return nil
+}
+
+// Close closes the subscription, deleting it if it is not durable.
+func (s *Subscription) Close() error {
+	if s.durable {
+		return nil
+	}
+
+	return s.Unsubscribe()
+}
@@ -0,0 +1,388 @@
+// Package outbox implements the transactional outbox pattern, so writing to a
+// database and publishing jobs commit atomically even when the queues live in
+// a different backend.
+//
+// The jobs are written to an outbox table inside the transaction of the
+// caller, and a Relay publishes them to their queues afterwards. The delivery
+// is at-least-once: a relay crashing after publishing a job but before
+// marking it as published leaves it to be published again once its claim
+// expires. The jobs keep their ID, so the queues deduplicating by Job.ID,
+// such as the ones of dedup.New, drop the republications; the relay publishes
+// with mq.PublishDedup. The ID is also the primary key of the outbox table,
+// so the same job can't be written twice.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// DefaultTable is the default name of the outbox table.
+const DefaultTable = "mq_outbox"
+
+// Placeholder returns the placeholder of the nth argument of a statement,
+// starting at 1, which depends on the database driver.
+type Placeholder func(n int) string
+
+var (
+	// Question is the placeholder of MySQL and SQLite: ?.
+	Question Placeholder = func(int) string { return "?" }
+	// Dollar is the placeholder of PostgreSQL: $1, $2...
+	Dollar Placeholder = func(n int) string { return "$" + strconv.Itoa(n) }
+)
+
+// Outbox writes jobs to an outbox table. The times are stored as Unix
+// nanoseconds, so the table only needs portable column types, see Schema.
+type Outbox struct {
+	table string
+	ph    Placeholder
+}
+
+// New returns an Outbox using the given table and placeholder style. The
+// defaults are DefaultTable and Question.
+func New(table string, ph Placeholder) *Outbox {
+	if table == "" {
+		table = DefaultTable
+	}
+
+	if ph == nil {
+		ph = Question
+	}
+
+	return &Outbox{table: table, ph: ph}
+}
+
+// Schema returns the statement creating the outbox table. The type of the
+// job column may need to be adapted to the database, such as BYTEA in
+// PostgreSQL.
+func (o *Outbox) Schema() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+	id VARCHAR(255) PRIMARY KEY,
+	queue VARCHAR(255) NOT NULL,
+	job BLOB NOT NULL,
+	created BIGINT NOT NULL,
+	claimed_until BIGINT NOT NULL,
+	claim_id VARCHAR(255) NOT NULL,
+	published BIGINT NOT NULL,
+	attempts INTEGER NOT NULL,
+	last_error TEXT NOT NULL
+)`, o.table)
+}
+
+// Publish writes the job to the outbox inside the transaction, to be
+// published to the queue by a Relay once the transaction is committed.
+func (o *Outbox) Publish(tx *sql.Tx, queue string, j *mq.Job) error {
+	if j == nil || j.Size() == 0 {
+		return mq.ErrEmptyJob.New()
+	}
+
+	c := *j
+	c.Acknowledger = nil
+	data, err := msgpack.Marshal(&c)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(o.stmt(`INSERT INTO %s (id, queue, job, created, claimed_until, claim_id, published, attempts, last_error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		j.ID, queue, data, time.Now().UnixNano(), int64(0), "", int64(0), 0, "")
+	return err
+}
+
+// stmt returns the statement with the table name and the placeholders of the
+// Outbox.
+func (o *Outbox) stmt(format string) string {
+	s := fmt.Sprintf(format, o.table)
+	if o.ph(1) == "?" {
+		return s
+	}
+
+	var b strings.Builder
+	var n int
+	for _, r := range s {
+		if r == '?' {
+			n++
+			b.WriteString(o.ph(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// CleanupPolicy defines what happens to the rows of the jobs published.
+type CleanupPolicy struct {
+	delete    bool
+	retention time.Duration
+}
+
+// KeepPublished keeps the rows of the jobs published forever, marked as
+// published. It's the zero CleanupPolicy.
+func KeepPublished() CleanupPolicy {
+	return CleanupPolicy{}
+}
+
+// DeletePublished deletes the rows of the jobs as soon as they are published.
+func DeletePublished() CleanupPolicy {
+	return CleanupPolicy{delete: true}
+}
+
+// RetainPublished deletes the rows of the jobs published more than the given
+// duration ago.
+func RetainPublished(d time.Duration) CleanupPolicy {
+	return CleanupPolicy{retention: d}
+}
+
+// Config is the configuration of a Relay.
+type Config struct {
+	// BatchSize is the maximum number of jobs published by Relay.Once,
+	// 100 by default.
+	BatchSize int
+	// Interval is the time Relay.Run waits when there are no jobs to
+	// publish, a second by default.
+	Interval time.Duration
+	// ClaimTimeout is the time a job is claimed by a relay while it's
+	// published. If the relay crashes, the job is published by another one
+	// once the claim expires. A minute by default.
+	ClaimTimeout time.Duration
+	// RetryDelay is the time to wait before retrying a job whose
+	// publication failed, 10 seconds by default.
+	RetryDelay time.Duration
+	// Cleanup is the policy for the rows of the jobs published.
+	Cleanup CleanupPolicy
+}
+
+// Entry is a job of the outbox not published yet.
+type Entry struct {
+	// ID is the ID of the job.
+	ID string
+	// Queue is the queue the job is published to.
+	Queue string
+	// Job is the job encoded with msgpack.
+	Job []byte
+	// Attempts is the number of failed publications of the job.
+	Attempts int
+}
+
+// Store is the storage of the jobs of an outbox, as seen by a Relay. The jobs
+// are claimed by one relay at a time while they are published. The Store
+// returned by Outbox.Store keeps them in the outbox table.
+type Store interface {
+	// Pending returns up to limit jobs not published yet and not claimed at
+	// the given time, in the order they were written.
+	Pending(ctx context.Context, now time.Time, limit int) ([]Entry, error)
+	// Claim claims the job until the given time, it returns false if the
+	// job is already published or claimed at now.
+	Claim(ctx context.Context, id, claim string, now, until time.Time) (bool, error)
+	// Retry records a failed publication of the claimed job, which is not
+	// published again until the given time.
+	Retry(ctx context.Context, id, claim string, attempts int, lastError string, until time.Time) error
+	// Published marks the claimed job as published at the given time, or
+	// deletes it if delete is true.
+	Published(ctx context.Context, id, claim string, at time.Time, delete bool) error
+	// Cleanup deletes the jobs published before the given time.
+	Cleanup(ctx context.Context, before time.Time) error
+}
+
+// Store returns the Store of the outbox table in the database.
+func (o *Outbox) Store(db *sql.DB) Store {
+	return &sqlStore{db: db, o: o}
+}
+
+type sqlStore struct {
+	db *sql.DB
+	o  *Outbox
+}
+
+// Pending implements the Store interface.
+func (s *sqlStore) Pending(ctx context.Context, now time.Time, limit int) ([]Entry, error) {
+	rows, err := s.db.QueryContext(ctx, s.o.stmt(`SELECT id, queue, job, attempts FROM %s WHERE published = 0 AND claimed_until < ? ORDER BY created LIMIT `+strconv.Itoa(limit)), now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.ID, &e.Queue, &e.Job, &e.Attempts); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// Claim implements the Store interface.
+func (s *sqlStore) Claim(ctx context.Context, id, claim string, now, until time.Time) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.o.stmt(`UPDATE %s SET claim_id = ?, claimed_until = ? WHERE id = ? AND published = 0 AND claimed_until < ?`),
+		claim, until.UnixNano(), id, now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Retry implements the Store interface.
+func (s *sqlStore) Retry(ctx context.Context, id, claim string, attempts int, lastError string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.o.stmt(`UPDATE %s SET attempts = ?, last_error = ?, claimed_until = ? WHERE id = ? AND claim_id = ?`),
+		attempts, lastError, until.UnixNano(), id, claim)
+	return err
+}
+
+// Published implements the Store interface.
+func (s *sqlStore) Published(ctx context.Context, id, claim string, at time.Time, delete bool) error {
+	var err error
+	if delete {
+		_, err = s.db.ExecContext(ctx, s.o.stmt(`DELETE FROM %s WHERE id = ? AND claim_id = ?`),
+			id, claim)
+	} else {
+		_, err = s.db.ExecContext(ctx, s.o.stmt(`UPDATE %s SET published = ? WHERE id = ? AND claim_id = ?`),
+			at.UnixNano(), id, claim)
+	}
+
+	return err
+}
+
+// Cleanup implements the Store interface.
+func (s *sqlStore) Cleanup(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.o.stmt(`DELETE FROM %s WHERE published > 0 AND published < ?`),
+		before.UnixNano())
+	return err
+}
+
+// Relay publishes the jobs of an outbox to the queues of a Broker. Several
+// relays can run at the same time on the same outbox, every job is claimed by
+// only one of them at a time.
+type Relay struct {
+	s Store
+	b mq.Broker
+	c Config
+}
+
+// NewRelay returns a Relay publishing the jobs of the Store, usually the one
+// returned by Outbox.Store.
+func NewRelay(s Store, b mq.Broker, c Config) *Relay {
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+
+	if c.ClaimTimeout <= 0 {
+		c.ClaimTimeout = time.Minute
+	}
+
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = 10 * time.Second
+	}
+
+	return &Relay{s: s, b: b, c: c}
+}
+
+// Run publishes the jobs of the outbox until the context is cancelled, it
+// returns nil then. It stops and returns the first error of the Store.
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.Once(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.c.Interval):
+		}
+	}
+}
+
+// Once publishes a batch of the jobs of the outbox not published yet, in the
+// order they were written, and applies the cleanup policy. It returns the
+// number of jobs published. The jobs that can't be published are retried
+// after the RetryDelay, their error is recorded in the Store.
+func (r *Relay) Once(ctx context.Context) (int, error) {
+	entries, err := r.s.Pending(ctx, time.Now(), r.c.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var published int
+	for _, e := range entries {
+		ok, err := r.relay(ctx, e)
+		if err != nil {
+			return published, err
+		}
+
+		if ok {
+			published++
+		}
+	}
+
+	return published, r.cleanup(ctx)
+}
+
+// relay claims and publishes a job, it returns false if the job was claimed
+// by another relay or could not be published.
+func (r *Relay) relay(ctx context.Context, e Entry) (bool, error) {
+	claim := uuid.New().String()
+	now := time.Now()
+	ok, err := r.s.Claim(ctx, e.ID, claim, now, now.Add(r.c.ClaimTimeout))
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if err := r.publish(e); err != nil {
+		return false, r.s.Retry(ctx, e.ID, claim, e.Attempts+1, err.Error(),
+			time.Now().Add(r.c.RetryDelay))
+	}
+
+	err = r.s.Published(ctx, e.ID, claim, time.Now(), r.c.Cleanup.delete)
+	return err == nil, err
+}
+
+func (r *Relay) publish(e Entry) error {
+	var j mq.Job
+	if err := msgpack.Unmarshal(e.Job, &j); err != nil {
+		return err
+	}
+
+	q, err := r.b.Queue(e.Queue)
+	if err != nil {
+		return err
+	}
+
+	_, err = mq.PublishDedup(q, &j)
+	return err
+}
+
+func (r *Relay) cleanup(ctx context.Context) error {
+	if r.c.Cleanup.retention <= 0 {
+		return nil
+	}
+
+	return r.s.Cleanup(ctx, time.Now().Add(-r.c.Cleanup.retention))
+}
@@ -0,0 +1,541 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+	"github.com/go-mq/mq/v2/test"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+func TestRelay(t *testing.T) {
+	require := require.New(t)
+
+	s := newMemoryStore()
+	b := memory.New()
+	r := NewRelay(s, b, Config{})
+
+	n, err := r.Once(context.Background())
+	require.NoError(err)
+	require.Equal(0, n)
+
+	jobs := []*mq.Job{test.NewJob(t, "first"), test.NewJob(t, "second")}
+	for _, j := range jobs {
+		s.add(t, "jobs", j)
+	}
+
+	n, err = r.Once(context.Background())
+	require.NoError(err)
+	require.Equal(2, n)
+
+	n, err = r.Once(context.Background())
+	require.NoError(err)
+	require.Equal(0, n)
+
+	require.Equal([]string{"first", "second"}, consume(t, b, "jobs"))
+	for _, j := range jobs {
+		require.False(s.row(j.ID).published.IsZero())
+	}
+}
+
+func TestRelay_crash(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.New()
+	q, err := b.Queue("jobs")
+	require.NoError(err)
+	q.(*memory.Queue).SetDedupWindow(time.Minute)
+
+	s := newMemoryStore()
+	j := test.NewJob(t, "job")
+	s.add(t, "jobs", j)
+
+	// a relay published the job and crashed before marking it as published
+	require.NoError(q.Publish(j))
+	s.row(j.ID).claimID = "crashed"
+	s.row(j.ID).claimedUntil = time.Now().Add(50 * time.Millisecond)
+
+	r := NewRelay(s, b, Config{})
+	n, err := r.Once(context.Background())
+	require.NoError(err)
+	require.Equal(0, n)
+
+	time.Sleep(60 * time.Millisecond)
+	n, err = r.Once(context.Background())
+	require.NoError(err)
+	require.Equal(1, n)
+
+	// the republication was deduplicated
+	require.Equal([]string{"job"}, consume(t, b, "jobs"))
+}
+
+func TestRelay_retry(t *testing.T) {
+	require := require.New(t)
+
+	s := newMemoryStore()
+	j := test.NewJob(t, "job")
+	s.add(t, "jobs", j)
+
+	b := &failingBroker{Broker: memory.New(), fail: true}
+	r := NewRelay(s, b, Config{RetryDelay: 50 * time.Millisecond})
+
+	n, err := r.Once(context.Background())
+	require.NoError(err)
+	require.Equal(0, n)
+	require.Equal(1, s.row(j.ID).Attempts)
+	require.Equal("broker down", s.row(j.ID).lastError)
+
+	// the job is not retried before the delay
+	b.setFail(false)
+	n, err = r.Once(context.Background())
+	require.NoError(err)
+	require.Equal(0, n)
+
+	time.Sleep(60 * time.Millisecond)
+	n, err = r.Once(context.Background())
+	require.NoError(err)
+	require.Equal(1, n)
+	require.Equal([]string{"job"}, consume(t, b, "jobs"))
+}
+
+func TestRelay_cleanup(t *testing.T) {
+	require := require.New(t)
+
+	for name, policy := range map[string]CleanupPolicy{
+		"delete": DeletePublished(),
+		"retain": RetainPublished(20 * time.Millisecond),
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := newMemoryStore()
+			j := test.NewJob(t, "job")
+			s.add(t, "jobs", j)
+
+			r := NewRelay(s, memory.New(), Config{Cleanup: policy})
+			n, err := r.Once(context.Background())
+			require.NoError(err)
+			require.Equal(1, n)
+
+			if policy.retention > 0 {
+				require.NotNil(s.row(j.ID))
+				time.Sleep(30 * time.Millisecond)
+				_, err = r.Once(context.Background())
+				require.NoError(err)
+			}
+
+			require.Nil(s.row(j.ID))
+		})
+	}
+}
+
+func TestRelay_Run(t *testing.T) {
+	require := require.New(t)
+
+	s := newMemoryStore()
+	b := memory.New()
+	r := NewRelay(s, b, Config{Interval: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	s.add(t, "jobs", test.NewJob(t, "job"))
+
+	q, err := b.Queue("jobs")
+	require.NoError(err)
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.NoError(j.Ack())
+
+	cancel()
+	require.NoError(<-done)
+}
+
+func TestOutbox_stmt(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("DELETE FROM t WHERE id = $1 AND claim_id = $2",
+		New("t", Dollar).stmt("DELETE FROM %s WHERE id = ? AND claim_id = ?"))
+	require.Equal("DELETE FROM mq_outbox WHERE id = ?",
+		New("", nil).stmt("DELETE FROM %s WHERE id = ?"))
+}
+
+func TestOutbox_Publish(t *testing.T) {
+	require := require.New(t)
+
+	db, d := openDB(t)
+	o := New("outbox", Dollar)
+
+	tx, err := db.Begin()
+	require.NoError(err)
+	require.True(mq.ErrEmptyJob.Is(o.Publish(tx, "jobs", nil)))
+
+	j := test.NewJob(t, "job")
+	require.NoError(o.Publish(tx, "jobs", j))
+	require.NoError(tx.Commit())
+
+	calls := d.recorded()
+	require.Len(calls, 1)
+	require.Equal("INSERT INTO outbox (id, queue, job, created, claimed_until, claim_id, published, attempts, last_error) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)", calls[0].query)
+	require.Equal(j.ID, calls[0].args[0])
+	require.Equal("jobs", calls[0].args[1])
+	require.Equal([]driver.Value{int64(0), "", int64(0), int64(0), ""}, calls[0].args[4:])
+
+	var written mq.Job
+	require.NoError(msgpack.Unmarshal(calls[0].args[2].([]byte), &written))
+	require.Equal(j.ID, written.ID)
+	require.Equal(j.Raw, written.Raw)
+}
+
+func TestStore(t *testing.T) {
+	require := require.New(t)
+
+	db, d := openDB(t)
+	s := New("", nil).Store(db)
+	ctx := context.Background()
+	now := time.Unix(0, 100)
+	until := time.Unix(0, 200)
+
+	d.rows = [][]driver.Value{{"id", "jobs", []byte("job"), int64(2)}}
+	entries, err := s.Pending(ctx, now, 10)
+	require.NoError(err)
+	require.Equal([]Entry{{ID: "id", Queue: "jobs", Job: []byte("job"), Attempts: 2}}, entries)
+
+	d.affected = 1
+	ok, err := s.Claim(ctx, "id", "claim", now, until)
+	require.NoError(err)
+	require.True(ok)
+
+	d.affected = 0
+	ok, err = s.Claim(ctx, "id", "claim", now, until)
+	require.NoError(err)
+	require.False(ok)
+
+	require.NoError(s.Retry(ctx, "id", "claim", 3, "failed", until))
+	require.NoError(s.Published(ctx, "id", "claim", now, false))
+	require.NoError(s.Published(ctx, "id", "claim", now, true))
+	require.NoError(s.Cleanup(ctx, now))
+
+	require.Equal([]call{
+		{"SELECT id, queue, job, attempts FROM mq_outbox WHERE published = 0 AND claimed_until < ? ORDER BY created LIMIT 10",
+			[]driver.Value{int64(100)}},
+		{"UPDATE mq_outbox SET claim_id = ?, claimed_until = ? WHERE id = ? AND published = 0 AND claimed_until < ?",
+			[]driver.Value{"claim", int64(200), "id", int64(100)}},
+		{"UPDATE mq_outbox SET claim_id = ?, claimed_until = ? WHERE id = ? AND published = 0 AND claimed_until < ?",
+			[]driver.Value{"claim", int64(200), "id", int64(100)}},
+		{"UPDATE mq_outbox SET attempts = ?, last_error = ?, claimed_until = ? WHERE id = ? AND claim_id = ?",
+			[]driver.Value{int64(3), "failed", int64(200), "id", "claim"}},
+		{"UPDATE mq_outbox SET published = ? WHERE id = ? AND claim_id = ?",
+			[]driver.Value{int64(100), "id", "claim"}},
+		{"DELETE FROM mq_outbox WHERE id = ? AND claim_id = ?",
+			[]driver.Value{"id", "claim"}},
+		{"DELETE FROM mq_outbox WHERE published > 0 AND published < ?",
+			[]driver.Value{int64(100)}},
+	}, d.recorded())
+}
+
+type failingBroker struct {
+	mq.Broker
+	mu   sync.Mutex
+	fail bool
+}
+
+func (b *failingBroker) setFail(fail bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fail = fail
+}
+
+func (b *failingBroker) Queue(name string) (mq.Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fail {
+		return nil, errors.New("broker down")
+	}
+
+	return b.Broker.Queue(name)
+}
+
+func consume(t *testing.T, b mq.Broker, queue string) []string {
+	q, err := b.Queue(queue)
+	require.NoError(t, err)
+
+	stats, err := q.(mq.Inspector).Stats()
+	require.NoError(t, err)
+
+	iter, err := q.Consume(0)
+	require.NoError(t, err)
+	defer iter.Close()
+
+	var payloads []string
+	for i := 0; i < stats.Ready; i++ {
+		j, err := iter.Next()
+		require.NoError(t, err)
+
+		var payload string
+		require.NoError(t, j.Decode(&payload))
+		require.NoError(t, j.Ack())
+		payloads = append(payloads, payload)
+	}
+
+	return payloads
+}
+
+// memoryStore is a Store keeping the jobs in memory, in the order they were
+// added.
+type memoryStore struct {
+	mu   sync.Mutex
+	rows []*row
+}
+
+type row struct {
+	Entry
+	claimID      string
+	claimedUntil time.Time
+	published    time.Time
+	lastError    string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+// add writes the job as Outbox.Publish does.
+func (s *memoryStore) add(t *testing.T, queue string, j *mq.Job) {
+	c := *j
+	c.Acknowledger = nil
+	data, err := msgpack.Marshal(&c)
+	require.NoError(t, err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rows = append(s.rows, &row{Entry: Entry{ID: j.ID, Queue: queue, Job: data}})
+}
+
+func (s *memoryStore) row(id string) *row {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.rows {
+		if r.ID == id {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// claimed returns the row of the job claimed, or nil. Must be called with the
+// lock held.
+func (s *memoryStore) claimed(id, claim string) *row {
+	for _, r := range s.rows {
+		if r.ID == id && r.claimID == claim {
+			return r
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Pending(_ context.Context, now time.Time, limit int) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []Entry
+	for _, r := range s.rows {
+		if len(entries) < limit && r.published.IsZero() && r.claimedUntil.Before(now) {
+			entries = append(entries, r.Entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *memoryStore) Claim(_ context.Context, id, claim string, now, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.rows {
+		if r.ID == id && r.published.IsZero() && r.claimedUntil.Before(now) {
+			r.claimID, r.claimedUntil = claim, until
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *memoryStore) Retry(_ context.Context, id, claim string, attempts int, lastError string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.claimed(id, claim); r != nil {
+		r.Attempts, r.lastError, r.claimedUntil = attempts, lastError, until
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Published(_ context.Context, id, claim string, at time.Time, delete bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.claimed(id, claim)
+	if r == nil {
+		return nil
+	}
+
+	if !delete {
+		r.published = at
+		return nil
+	}
+
+	for i := range s.rows {
+		if s.rows[i] == r {
+			s.rows = append(s.rows[:i], s.rows[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Cleanup(_ context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []*row
+	for _, r := range s.rows {
+		if r.published.IsZero() || !r.published.Before(before) {
+			kept = append(kept, r)
+		}
+	}
+
+	s.rows = kept
+	return nil
+}
+
+// recorder is a database/sql driver recording the statements executed. The
+// queries return its rows, and the other statements report its affected
+// rows.
+type recorder struct {
+	mu       sync.Mutex
+	calls    []call
+	rows     [][]driver.Value
+	affected int64
+}
+
+type call struct {
+	query string
+	args  []driver.Value
+}
+
+var drivers = struct {
+	sync.Mutex
+	m map[string]*recorder
+}{m: make(map[string]*recorder)}
+
+func init() {
+	sql.Register("outboxtest", recorderDriver{})
+}
+
+func openDB(t *testing.T) (*sql.DB, *recorder) {
+	d := &recorder{}
+	drivers.Lock()
+	drivers.m[t.Name()] = d
+	drivers.Unlock()
+
+	db, err := sql.Open("outboxtest", t.Name())
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db, d
+}
+
+func (d *recorder) recorded() []call {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls
+}
+
+func (d *recorder) record(query string, args []driver.Value) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, call{query: query, args: args})
+}
+
+type recorderDriver struct{}
+
+func (recorderDriver) Open(name string) (driver.Conn, error) {
+	drivers.Lock()
+	defer drivers.Unlock()
+	return recorderConn{drivers.m[name]}, nil
+}
+
+type recorderConn struct {
+	d *recorder
+}
+
+func (c recorderConn) Prepare(query string) (driver.Stmt, error) {
+	return recorderStmt{d: c.d, query: query}, nil
+}
+
+func (c recorderConn) Close() error              { return nil }
+func (c recorderConn) Begin() (driver.Tx, error) { return recorderTx{}, nil }
+
+type recorderTx struct{}
+
+func (recorderTx) Commit() error   { return nil }
+func (recorderTx) Rollback() error { return nil }
+
+type recorderStmt struct {
+	d     *recorder
+	query string
+}
+
+func (s recorderStmt) Close() error  { return nil }
+func (s recorderStmt) NumInput() int { return -1 }
+
+func (s recorderStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.record(s.query, args)
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	return driver.RowsAffected(s.d.affected), nil
+}
+
+func (s recorderStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.record(s.query, args)
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	return &recorderRows{rows: s.d.rows}, nil
+}
+
+type recorderRows struct {
+	rows [][]driver.Value
+}
+
+func (r *recorderRows) Columns() []string {
+	return []string{"id", "queue", "job", "attempts"}
+}
+
+func (r *recorderRows) Close() error {
+	return nil
+}
+
+func (r *recorderRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
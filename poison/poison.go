@@ -0,0 +1,199 @@
+// Package poison implements the detection and quarantine of poison jobs,
+// jobs that fail every time they are processed and would be requeued
+// forever otherwise.
+package poison
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+)
+
+// ErrorType is the ErrorType given to quarantined jobs.
+const ErrorType = "poison"
+
+// KeyFunc returns the key used to track the failures of a job.
+type KeyFunc func(*mq.Job) string
+
+// ByID tracks the failures of the jobs by their ID.
+func ByID(j *mq.Job) string {
+	return j.ID
+}
+
+// ByPayload tracks the failures of the jobs by the hash of their payload, so
+// the failures of different jobs with the same payload are counted together.
+func ByPayload(j *mq.Job) string {
+	sum := sha256.Sum256(j.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Policy defines when a job is considered poison and what to do with it.
+type Policy struct {
+	// MaxFailures is the number of failures after which a job is
+	// quarantined, values lower than 1 quarantine on the first failure.
+	MaxFailures int
+	// Window is the period of time in which the failures are counted. Use 0
+	// to count all the failures.
+	Window time.Duration
+	// Key returns the key the failures are tracked by, ByID by default.
+	Key KeyFunc
+	// Quarantine is the queue the poison jobs are moved to. If nil, the
+	// poison jobs are buried in their own queue.
+	Quarantine mq.Queue
+}
+
+// Detector tracks the failures of the jobs and quarantines them following
+// its Policy. A Detector can be shared by many iterators.
+type Detector struct {
+	policy Policy
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+// New returns a new Detector with the given Policy.
+func New(p Policy) *Detector {
+	if p.Key == nil {
+		p.Key = ByID
+	}
+
+	return &Detector{
+		policy:   p,
+		failures: make(map[string][]time.Time),
+	}
+}
+
+// Wrap returns a JobIter whose jobs are tracked by the Detector. A job
+// rejected with requeue is quarantined instead once the Policy is met.
+func (d *Detector) Wrap(iter mq.JobIter) mq.JobIter {
+	return &jobIter{JobIter: iter, d: d}
+}
+
+// Failures returns the number of failures tracked for the given job.
+func (d *Detector) Failures(j *mq.Job) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.prune(d.policy.Key(j), time.Now()))
+}
+
+// fail records a failure of the job, it returns true if the job is poison.
+// The failures are kept until the job is quarantined.
+func (d *Detector) fail(j *mq.Job) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	key := d.policy.Key(j)
+	failures := append(d.prune(key, now), now)
+	d.failures[key] = failures
+	return len(failures) >= d.policy.MaxFailures
+}
+
+func (d *Detector) forget(j *mq.Job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.failures, d.policy.Key(j))
+}
+
+// prune removes the failures out of the window. Must be called with the lock
+// held.
+func (d *Detector) prune(key string, now time.Time) []time.Time {
+	failures := d.failures[key]
+	if d.policy.Window <= 0 {
+		return failures
+	}
+
+	limit := now.Add(-d.policy.Window)
+	for len(failures) > 0 && failures[0].Before(limit) {
+		failures = failures[1:]
+	}
+
+	if len(failures) == 0 {
+		delete(d.failures, key)
+	}
+
+	return failures
+}
+
+// quarantine moves the job to the quarantine queue or buries it, forgetting
+// its failures once it's done. If the job can't be published to the
+// quarantine queue, it's requeued and the error returned, its failures are
+// kept so it's quarantined again on its next failure. If the job can't be
+// acknowledged once quarantined, because its lease expired and it is back in
+// its queue, the quarantined copy is canceled if the quarantine queue
+// implements mq.Canceler.
+func (d *Detector) quarantine(j *mq.Job, a mq.Acknowledger) error {
+	j.ErrorType = ErrorType
+	if d.policy.Quarantine == nil {
+		if err := a.Reject(false); err != nil {
+			return err
+		}
+
+		d.forget(j)
+		return nil
+	}
+
+	poison := *j
+	poison.Acknowledger = nil
+	if err := d.policy.Quarantine.Publish(&poison); err != nil {
+		j.ErrorType = ""
+		a.Reject(true)
+		return err
+	}
+
+	if err := a.Ack(); err != nil {
+		mq.Cancel(d.policy.Quarantine, poison.ID)
+		return err
+	}
+
+	d.forget(j)
+	return nil
+}
+
+type jobIter struct {
+	mq.JobIter
+	d *Detector
+}
+
+// Next implements the mq.JobIter interface.
+func (i *jobIter) Next() (*mq.Job, error) {
+	j, err := i.JobIter.Next()
+	if err != nil || j == nil {
+		return j, err
+	}
+
+	j.Acknowledger = mq.WrapAcknowledger(j.Acknowledger,
+		&acknowledger{Acknowledger: j.Acknowledger, j: j, d: i.d})
+
+	return j, nil
+}
+
+type acknowledger struct {
+	mq.Acknowledger
+	j *mq.Job
+	d *Detector
+}
+
+// Ack implements the mq.Acknowledger interface.
+func (a *acknowledger) Ack() error {
+	a.d.forget(a.j)
+	return a.Acknowledger.Ack()
+}
+
+// Reject implements the mq.Acknowledger interface. A job rejected with
+// requeue is quarantined instead when it is considered poison.
+func (a *acknowledger) Reject(requeue bool) error {
+	if !requeue {
+		a.d.forget(a.j)
+		return a.Acknowledger.Reject(false)
+	}
+
+	if a.d.fail(a.j) {
+		return a.d.quarantine(a.j, a.Acknowledger)
+	}
+
+	return a.Acknowledger.Reject(true)
+}
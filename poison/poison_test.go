@@ -0,0 +1,184 @@
+package poison
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+	"github.com/go-mq/mq/v2/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetector_bury(t *testing.T) {
+	require := require.New(t)
+
+	q := newQueue(t, memory.NewFinite(true), "bury", "poison")
+	d := New(Policy{MaxFailures: 3})
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	iter = d.Wrap(iter)
+
+	for i := 0; i < 3; i++ {
+		j, err := iter.Next()
+		require.NoError(err)
+		require.EqualValues(i+1, j.Deliveries)
+		require.NoError(j.Reject(true))
+	}
+
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+
+	var buried *mq.Job
+	require.NoError(q.RepublishBuried(func(j *mq.Job) bool {
+		buried = j
+		return false
+	}))
+	require.NotNil(buried)
+	require.Equal(ErrorType, buried.ErrorType)
+	require.Zero(d.Failures(buried))
+}
+
+func TestDetector_quarantine(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	q := newQueue(t, b, "source", "poison")
+	quarantine, err := b.Queue("quarantine")
+	require.NoError(err)
+
+	d := New(Policy{MaxFailures: 2, Key: ByPayload, Quarantine: quarantine})
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	iter = d.Wrap(iter)
+
+	for i := 0; i < 2; i++ {
+		j, err := iter.Next()
+		require.NoError(err)
+		require.NoError(j.Reject(true))
+	}
+
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+
+	qIter, err := quarantine.Consume(0)
+	require.NoError(err)
+
+	j, err := qIter.Next()
+	require.NoError(err)
+	require.Equal(ErrorType, j.ErrorType)
+
+	var payload string
+	require.NoError(j.Decode(&payload))
+	require.Equal("poison", payload)
+}
+
+func TestDetector_quarantineExpired(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	q := newQueue(t, b, "source", "poison")
+	quarantine, err := b.Queue("quarantine")
+	require.NoError(err)
+
+	d := New(Policy{MaxFailures: 1, Quarantine: quarantine})
+
+	const timeout = 20 * time.Millisecond
+	iter, err := q.(*memory.Queue).ConsumeWithVisibility(0, timeout)
+	require.NoError(err)
+	iter = d.Wrap(iter)
+
+	j, err := iter.Next()
+	require.NoError(err)
+
+	// the job is back in its queue, so the quarantined copy is canceled
+	time.Sleep(2 * timeout)
+	require.True(mq.ErrLeaseExpired.Is(j.Reject(true)))
+
+	stats, err := quarantine.(mq.Inspector).Stats()
+	require.NoError(err)
+	require.Zero(stats.Ready)
+
+	stats, err = q.(mq.Inspector).Stats()
+	require.NoError(err)
+	require.Equal(1, stats.Ready)
+}
+
+type failingQueue struct {
+	mq.Queue
+}
+
+func (failingQueue) Publish(*mq.Job) error {
+	return errors.New("publish failed")
+}
+
+func TestDetector_quarantineFailed(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	q := newQueue(t, b, "source", "poison")
+	quarantine, err := b.Queue("quarantine")
+	require.NoError(err)
+
+	d := New(Policy{MaxFailures: 1, Quarantine: failingQueue{quarantine}})
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	iter = d.Wrap(iter)
+
+	// the job is requeued and its failures kept, so it's quarantined again
+	// on its next failure
+	j, err := iter.Next()
+	require.NoError(err)
+	require.EqualError(j.Reject(true), "publish failed")
+	require.Equal(1, d.Failures(j))
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.Empty(j.ErrorType)
+	require.EqualValues(2, j.Deliveries)
+	require.NoError(j.Ack())
+	require.Zero(d.Failures(j))
+}
+
+func TestDetector_window(t *testing.T) {
+	require := require.New(t)
+
+	q := newQueue(t, memory.NewFinite(true), "window", "poison")
+	d := New(Policy{MaxFailures: 2, Window: 20 * time.Millisecond})
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	iter = d.Wrap(iter)
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.NoError(j.Reject(true))
+	require.Equal(1, d.Failures(j))
+
+	// the first failure is out of the window when the second happens
+	time.Sleep(30 * time.Millisecond)
+	require.Zero(d.Failures(j))
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.NoError(j.Reject(true))
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.Empty(j.ErrorType)
+	require.NoError(j.Ack())
+	require.Zero(d.Failures(j))
+}
+
+func newQueue(t *testing.T, b mq.Broker, name string, payload string) mq.Queue {
+	q, err := b.Queue(name)
+	require.NoError(t, err)
+	test.Publish(t, q, payload)
+	return q
+}
@@ -0,0 +1,30 @@
+package mq
+
+import "context"
+
+type jobKey struct{}
+
+// ContextWithJob returns a copy of the context carrying the job being
+// processed, so the functions handling it can report its progress with
+// ReportProgress.
+func ContextWithJob(ctx context.Context, j *Job) context.Context {
+	return context.WithValue(ctx, jobKey{}, j)
+}
+
+// JobFromContext returns the job carried by the context, if any.
+func JobFromContext(ctx context.Context) (*Job, bool) {
+	j, ok := ctx.Value(jobKey{}).(*Job)
+	return j, ok
+}
+
+// ReportProgress reports the progress of the job carried by the context, see
+// Job.ReportProgress. It returns ErrProgressNotSupported if the context
+// carries no job.
+func ReportProgress(ctx context.Context, percent float64, message string) error {
+	j, ok := JobFromContext(ctx)
+	if !ok {
+		return ErrProgressNotSupported.New()
+	}
+
+	return j.ReportProgress(percent, message)
+}
@@ -0,0 +1,39 @@
+package mq_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportProgress_not_supported(t *testing.T) {
+	require := require.New(t)
+
+	j := mq.NewJob()
+	require.True(mq.ErrCantAck.Is(j.ReportProgress(50, "")))
+
+	err := mq.ReportProgress(context.Background(), 50, "")
+	require.True(mq.ErrProgressNotSupported.Is(err))
+
+	q, err := memory.New().Queue("progress")
+	require.NoError(err)
+	require.NoError(j.Encode(true))
+	require.NoError(q.Publish(j))
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err = iter.Next()
+	require.NoError(err)
+
+	ctx := mq.ContextWithJob(context.Background(), j)
+	fromCtx, ok := mq.JobFromContext(ctx)
+	require.True(ok)
+	require.Equal(j, fromCtx)
+	require.True(mq.ErrProgressNotSupported.Is(mq.ReportProgress(ctx, 50, "")))
+}
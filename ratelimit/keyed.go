@@ -0,0 +1,317 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+
+	"github.com/google/uuid"
+)
+
+// KeyFunc returns the key of a job the limits are applied to, such as its
+// tenant.
+type KeyFunc func(*mq.Job) string
+
+// HeaderKey returns a KeyFunc using the given header of the jobs as key.
+func HeaderKey(name string) KeyFunc {
+	return func(j *mq.Job) string {
+		return j.Headers[name]
+	}
+}
+
+// KeyedLimiter limits the number of jobs with the same key being processed
+// at the same time.
+type KeyedLimiter interface {
+	// Acquire takes a slot for the given key without waiting for one to be
+	// released. It returns false if there are no free slots, or a function
+	// releasing the slot otherwise.
+	Acquire(key string) (release func() error, ok bool, err error)
+}
+
+// NewKeyedLimiter returns a KeyedLimiter allowing up to limit jobs with the
+// same key at the same time, within the process.
+func NewKeyedLimiter(limit int) KeyedLimiter {
+	return &keyedLimiter{limit: limit, slots: make(map[string]int)}
+}
+
+type keyedLimiter struct {
+	limit int
+
+	mu    sync.Mutex
+	slots map[string]int
+}
+
+// Acquire implements the KeyedLimiter interface.
+func (l *keyedLimiter) Acquire(key string) (func() error, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.slots[key] >= l.limit {
+		return nil, false, nil
+	}
+
+	l.slots[key]++
+
+	var once sync.Once
+	return func() error {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.slots[key]--; l.slots[key] <= 0 {
+				delete(l.slots, key)
+			}
+		})
+
+		return nil
+	}, true, nil
+}
+
+// NewQueueLimiter returns a KeyedLimiter allowing up to limit jobs with the
+// same key at the same time across every process sharing the Broker. The
+// slots of every key are token jobs in a queue named after the prefix and the
+// key, a slot is taken by consuming a token and released by requeuing it.
+//
+// The tokens are published the first time a key is used by each process,
+// relying on their unique keys to never publish more than limit tokens. The
+// backends not supporting mq.Job.UniqueKey get a set of tokens from every
+// process, so N processes allow up to N times limit jobs at the same time;
+// with them, only one process must use the limiter, or limit must be divided
+// by the number of processes. Acquire waits up to wait for a free token. Each
+// key is consumed by a single JobIter per process, kept open from then on.
+func NewQueueLimiter(b mq.Broker, prefix string, limit int, wait time.Duration) KeyedLimiter {
+	return &queueLimiter{
+		b:      b,
+		prefix: prefix,
+		limit:  limit,
+		wait:   wait,
+		tokens: make(map[string]*tokens),
+	}
+}
+
+type queueLimiter struct {
+	b      mq.Broker
+	prefix string
+	limit  int
+	wait   time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*tokens
+}
+
+// Acquire implements the KeyedLimiter interface.
+func (l *queueLimiter) Acquire(key string) (func() error, bool, error) {
+	t, err := l.consume(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	token, err := t.take(l.wait)
+	if err != nil || token == nil {
+		return nil, false, err
+	}
+
+	var once sync.Once
+	return func() error {
+		var err error
+		once.Do(func() {
+			err = token.Reject(true)
+			if mq.ErrLeaseExpired.Is(err) {
+				err = nil
+			}
+		})
+
+		return err
+	}, true, nil
+}
+
+// consume returns the tokens of the key, publishing them and starting to
+// consume them if this process did not do it yet.
+func (l *queueLimiter) consume(key string) (*tokens, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t, ok := l.tokens[key]; ok {
+		return t, nil
+	}
+
+	q, err := l.b.Queue(l.prefix + key)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < l.limit; i++ {
+		token := mq.NewJob()
+		token.UniqueKey = fmt.Sprintf("token-%d", i)
+		if err := token.Encode(i); err != nil {
+			return nil, err
+		}
+
+		err := q.Publish(token)
+		if err != nil && !mq.ErrUniqueConflict.Is(err) {
+			return nil, err
+		}
+	}
+
+	iter, err := q.Consume(l.limit)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tokens{iter: iter, results: make(chan tokenResult)}
+	l.tokens[key] = t
+	return t, nil
+}
+
+// tokens hands the tokens of a key out to the callers of Acquire. The tokens
+// are fetched from the JobIter by one goroutine at a time, while there are
+// callers waiting for them.
+type tokens struct {
+	iter    mq.JobIter
+	results chan tokenResult
+
+	mu       sync.Mutex
+	waiting  int
+	fetching bool
+}
+
+type tokenResult struct {
+	token *mq.Job
+	err   error
+}
+
+// take waits up to the given duration for a token, it returns nil if there
+// is none.
+func (t *tokens) take(wait time.Duration) (*mq.Job, error) {
+	t.mu.Lock()
+	t.waiting++
+	if !t.fetching {
+		t.fetching = true
+		go t.fetch()
+	}
+
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.waiting--
+		t.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case r := <-t.results:
+		return r.token, r.err
+	case <-timer.C:
+		return nil, nil
+	}
+}
+
+// fetch takes tokens from the JobIter until there are no callers waiting.
+func (t *tokens) fetch() {
+	for {
+		token, err := t.iter.Next()
+		select {
+		case t.results <- tokenResult{token: token, err: err}:
+		default:
+			// a token taken after its caller gave up is requeued
+			if token != nil {
+				token.Reject(true)
+			}
+		}
+
+		t.mu.Lock()
+		if t.waiting == 0 || err != nil {
+			t.fetching = false
+			t.mu.Unlock()
+			return
+		}
+
+		t.mu.Unlock()
+	}
+}
+
+// Defer returns a JobIter that only returns the jobs allowed by the
+// KeyedLimiter, keyed by the given KeyFunc. The rest of them are deferred,
+// published again to the queue with the given delay, so the consumer does
+// not wait for their slots. A slot is released when its job is acknowledged
+// or rejected.
+func Defer(
+	iter mq.JobIter,
+	q mq.Queue,
+	l KeyedLimiter,
+	key KeyFunc,
+	delay time.Duration,
+) mq.JobIter {
+	return &deferIter{JobIter: iter, q: q, l: l, key: key, delay: delay}
+}
+
+type deferIter struct {
+	mq.JobIter
+	q     mq.Queue
+	l     KeyedLimiter
+	key   KeyFunc
+	delay time.Duration
+}
+
+// Next implements the mq.JobIter interface.
+func (i *deferIter) Next() (*mq.Job, error) {
+	for {
+		j, err := i.JobIter.Next()
+		if err != nil || j == nil {
+			return j, err
+		}
+
+		release, ok, err := i.l.Acquire(i.key(j))
+		if err != nil {
+			j.Reject(true)
+			return nil, err
+		}
+
+		if ok {
+			j.Acknowledger = mq.WrapAcknowledger(j.Acknowledger,
+				&acknowledger{Acknowledger: j.Acknowledger, release: release})
+
+			return j, nil
+		}
+
+		if err := i.postpone(j); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// postpone publishes the job again with a delay, and acknowledges it once
+// the copy is published. The copy keeps the ID of the job, but it gets a new
+// DedupKey so it's not dropped as a duplicate of the job, and no UniqueKey,
+// so it doesn't conflict with the job while it is still running. If the copy
+// can't be published, the job is requeued.
+func (i *deferIter) postpone(j *mq.Job) error {
+	deferred := *j
+	deferred.Acknowledger = nil
+	deferred.DedupKey = uuid.New().String()
+	deferred.UniqueKey = ""
+	if err := i.q.PublishDelayed(&deferred, i.delay); err != nil {
+		j.Reject(true)
+		return err
+	}
+
+	return j.Ack()
+}
+
+type acknowledger struct {
+	mq.Acknowledger
+	release func() error
+}
+
+// Ack implements the mq.Acknowledger interface.
+func (a *acknowledger) Ack() error {
+	defer a.release()
+	return a.Acknowledger.Ack()
+}
+
+// Reject implements the mq.Acknowledger interface.
+func (a *acknowledger) Reject(requeue bool) error {
+	defer a.release()
+	return a.Acknowledger.Reject(requeue)
+}
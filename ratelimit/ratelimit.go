@@ -0,0 +1,175 @@
+// Package ratelimit implements consumer-side rate limiting of jobs, using
+// token buckets limiting the number of jobs and bytes per second.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+)
+
+// Limiter limits the rate of jobs and, optionally, bytes per second. Its
+// limits can be changed at any time, and it can be shared by many iterators
+// to limit their combined rate.
+type Limiter struct {
+	mu    sync.Mutex
+	jobs  bucket
+	bytes bucket
+}
+
+// NewLimiter returns a Limiter allowing the given number of jobs per second,
+// with bursts of up to burst jobs. A rate of 0 or less means no limit.
+func NewLimiter(jobsPerSecond float64, burst int) *Limiter {
+	l := &Limiter{}
+	l.SetRate(jobsPerSecond, burst)
+	return l
+}
+
+// SetRate changes the number of jobs per second and the burst allowed.
+func (l *Limiter) SetRate(jobsPerSecond float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.jobs.set(time.Now(), jobsPerSecond, burst)
+}
+
+// SetByteRate changes the number of bytes per second, counted by the size of
+// the jobs, and the burst allowed. A rate of 0 or less means no limit, which
+// is the default.
+func (l *Limiter) SetByteRate(bytesPerSecond float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytes.set(time.Now(), bytesPerSecond, burst)
+}
+
+// Wait blocks until a job is allowed or the context is done.
+func (l *Limiter) Wait(ctx context.Context) error {
+	return l.wait(ctx, &l.jobs, 1)
+}
+
+// WaitBytes blocks until the given number of bytes is allowed or the context
+// is done. Sizes bigger than the burst are allowed, delaying the following
+// ones accordingly.
+func (l *Limiter) WaitBytes(ctx context.Context, n int) error {
+	return l.wait(ctx, &l.bytes, float64(n))
+}
+
+func (l *Limiter) wait(ctx context.Context, b *bucket, n float64) error {
+	l.mu.Lock()
+	delay := b.reserve(time.Now(), n)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		b.cancel(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// bucket is a token bucket, allowed to go into debt to reserve tokens in
+// advance.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) set(now time.Time, rate float64, burst int) {
+	first := b.last.IsZero()
+	b.advance(now)
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.burst < 1 {
+		b.burst = 1
+	}
+
+	if first || b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *bucket) advance(now time.Time) {
+	if b.rate > 0 && !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+
+	b.last = now
+}
+
+// reserve takes n tokens, returning how long to wait until they are
+// available.
+func (b *bucket) reserve(now time.Time, n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.advance(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back the tokens of a reservation that was not used.
+func (b *bucket) cancel(n float64) {
+	if b.rate > 0 {
+		b.tokens += n
+	}
+}
+
+// Wrap returns a JobIter whose Next blocks until the Limiter allows the next
+// job. Closing the returned JobIter interrupts the wait.
+func Wrap(iter mq.JobIter, l *Limiter) mq.JobIter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobIter{JobIter: iter, l: l, ctx: ctx, cancel: cancel}
+}
+
+type jobIter struct {
+	mq.JobIter
+	l      *Limiter
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Next implements the mq.JobIter interface.
+func (i *jobIter) Next() (*mq.Job, error) {
+	if err := i.l.Wait(i.ctx); err != nil {
+		return nil, mq.ErrAlreadyClosed.New()
+	}
+
+	j, err := i.JobIter.Next()
+	if err != nil || j == nil {
+		return j, err
+	}
+
+	if err := i.l.WaitBytes(i.ctx, j.Size()); err != nil {
+		j.Reject(true)
+		return nil, mq.ErrAlreadyClosed.New()
+	}
+
+	return j, nil
+}
+
+// Close implements the mq.JobIter interface.
+func (i *jobIter) Close() error {
+	i.cancel()
+	return i.JobIter.Close()
+}
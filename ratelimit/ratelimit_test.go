@@ -0,0 +1,296 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_Wait(t *testing.T) {
+	require := require.New(t)
+
+	l := NewLimiter(100, 5)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		require.NoError(l.Wait(ctx))
+	}
+
+	// 5 jobs of burst, and 10 more at 100 jobs/s
+	elapsed := time.Since(start)
+	require.True(elapsed >= 90*time.Millisecond, "elapsed %s", elapsed)
+	require.True(elapsed < time.Second, "elapsed %s", elapsed)
+
+	// raising the limit at runtime
+	l.SetRate(0, 0)
+	start = time.Now()
+	for i := 0; i < 1000; i++ {
+		require.NoError(l.Wait(ctx))
+	}
+	require.True(time.Since(start) < 50*time.Millisecond)
+}
+
+func TestLimiter_WaitBytes(t *testing.T) {
+	require := require.New(t)
+
+	l := NewLimiter(0, 0)
+	l.SetByteRate(1000, 100)
+
+	ctx := context.Background()
+	start := time.Now()
+	require.NoError(l.WaitBytes(ctx, 100))
+	require.NoError(l.WaitBytes(ctx, 100))
+	require.True(time.Since(start) >= 90*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.Equal(context.DeadlineExceeded, l.WaitBytes(ctx, 1000))
+}
+
+func TestWrap(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.New().Queue("ratelimit")
+	require.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		j := mq.NewJob()
+		require.NoError(j.Encode(i))
+		require.NoError(q.Publish(j))
+	}
+
+	// the limiter is shared by both iterators
+	l := NewLimiter(200, 1)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		iter, err := q.Consume(0)
+		require.NoError(err)
+		iter = Wrap(iter, l)
+		defer iter.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				j, err := iter.Next()
+				require.NoError(err)
+				require.NoError(j.Ack())
+			}
+		}()
+	}
+
+	wg.Wait()
+	require.True(time.Since(start) >= 40*time.Millisecond)
+
+	// closing the iterator interrupts the wait
+	l.SetRate(0.1, 1)
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	iter = Wrap(iter, l)
+
+	done := make(chan error)
+	go func() {
+		_, err := iter.Next()
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(iter.Close())
+	require.True(mq.ErrAlreadyClosed.Is(<-done))
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	require := require.New(t)
+
+	l := NewKeyedLimiter(2)
+	release, ok, err := l.Acquire("a")
+	require.NoError(err)
+	require.True(ok)
+
+	_, ok, _ = l.Acquire("a")
+	require.True(ok)
+	_, ok, _ = l.Acquire("a")
+	require.False(ok)
+	_, ok, _ = l.Acquire("b")
+	require.True(ok)
+
+	require.NoError(release())
+	require.NoError(release())
+	_, ok, _ = l.Acquire("a")
+	require.True(ok)
+	_, ok, _ = l.Acquire("a")
+	require.False(ok)
+}
+
+func TestQueueLimiter(t *testing.T) {
+	require := require.New(t)
+
+	// two limiters sharing the broker, as if they were in different
+	// processes; the memory iterators poll the empty queues every second
+	b := memory.New()
+	l1 := NewQueueLimiter(b, "tenants.", 1, 50*time.Millisecond)
+	l2 := NewQueueLimiter(b, "tenants.", 1, 2*time.Second)
+
+	release, ok, err := l1.Acquire("a")
+	require.NoError(err)
+	require.True(ok)
+
+	_, ok, err = l1.Acquire("a")
+	require.NoError(err)
+	require.False(ok)
+
+	require.NoError(release())
+	release, ok, err = l2.Acquire("a")
+	require.NoError(err)
+	require.True(ok)
+
+	_, ok, err = l1.Acquire("a")
+	require.NoError(err)
+	require.False(ok)
+	require.NoError(release())
+
+	release, ok, err = l2.Acquire("a")
+	require.NoError(err)
+	require.True(ok)
+	require.NoError(release())
+}
+
+func TestDefer(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.NewFinite(true).Queue("defer")
+	require.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		j := mq.NewJob()
+		j.Headers = map[string]string{"tenant": "a"}
+		require.NoError(j.Encode(i))
+		require.NoError(q.Publish(j))
+	}
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+
+	const delay = 20 * time.Millisecond
+	iter = Defer(iter, q, NewKeyedLimiter(1), HeaderKey("tenant"), delay)
+
+	j, err := iter.Next()
+	require.NoError(err)
+
+	// the other jobs of the tenant are deferred
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+	require.NoError(j.Ack())
+
+	time.Sleep(2 * delay)
+	for i := 0; i < 2; i++ {
+		j, err := iter.Next()
+		require.NoError(err)
+		require.NoError(j.Ack())
+	}
+}
+
+func TestDefer_dedup(t *testing.T) {
+	testDeferred(t, func(q *memory.Queue, j *mq.Job) {
+		q.SetDedupWindow(time.Minute)
+	})
+}
+
+func TestDefer_unique(t *testing.T) {
+	testDeferred(t, func(q *memory.Queue, j *mq.Job) {
+		j.UniqueKey = j.ID
+	})
+}
+
+type failingQueue struct {
+	mq.Queue
+}
+
+func (failingQueue) PublishDelayed(*mq.Job, time.Duration) error {
+	return errors.New("publish failed")
+}
+
+func TestDefer_publishFailed(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.NewFinite(true).Queue("defer")
+	require.NoError(err)
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		j := mq.NewJob()
+		j.Headers = map[string]string{"tenant": "a"}
+		j.UniqueKey = j.ID
+		require.NoError(j.Encode(i))
+		require.NoError(q.Publish(j))
+		ids = append(ids, j.ID)
+	}
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	iter = Defer(iter, failingQueue{q}, NewKeyedLimiter(1), HeaderKey("tenant"), time.Millisecond)
+
+	j, err := iter.Next()
+	require.NoError(err)
+
+	// the job that can't be deferred is requeued, not lost
+	_, err = iter.Next()
+	require.EqualError(err, "publish failed")
+	require.NoError(j.Ack())
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.Equal(ids[1], j.ID)
+	require.NoError(j.Ack())
+}
+
+// testDeferred checks that a deferred job is delivered again after the
+// delay, once the queue and the job are set up by the given function.
+func testDeferred(t *testing.T, setup func(*memory.Queue, *mq.Job)) {
+	require := require.New(t)
+
+	queue, err := memory.NewFinite(true).Queue("defer")
+	require.NoError(err)
+	q := queue.(*memory.Queue)
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		j := mq.NewJob()
+		j.Headers = map[string]string{"tenant": "a"}
+		require.NoError(j.Encode(i))
+		setup(q, j)
+		require.NoError(q.Publish(j))
+		ids = append(ids, j.ID)
+	}
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+
+	const delay = 20 * time.Millisecond
+	iter = Defer(iter, q, NewKeyedLimiter(1), HeaderKey("tenant"), delay)
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Equal(ids[0], j.ID)
+
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+	require.NoError(j.Ack())
+
+	time.Sleep(2 * delay)
+	j, err = iter.Next()
+	require.NoError(err)
+	require.Equal(ids[1], j.ID)
+	require.NoError(j.Ack())
+}
@@ -0,0 +1,383 @@
+// Package results implements the tracking of the state of the jobs and the
+// storage of their results, so the publisher of a job can learn whether it
+// finished and what it returned.
+//
+// A Tracker is an mq.Hook: once added to a broker with mq.AddHook, it records
+// the state of every job published, delivered, acknowledged or rejected in
+// its queues, keyed by Job.ID, in a pluggable Store. The JobIters wrapped by
+// the Tracker also record the progress reported by the handlers of the jobs.
+package results
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+var (
+	// ErrNotFound is returned when there is no record for a job.
+	ErrNotFound = errors.NewKind("no record for job %s")
+	// ErrInvalidProgress is returned when reporting a percent out of the
+	// range from 0 to 100.
+	ErrInvalidProgress = errors.NewKind("invalid progress percent: %v")
+)
+
+// JobIDHeader is the header with the ID of the job whose progress is
+// reported by the jobs published to the progress topic.
+const JobIDHeader = "progress-job-id"
+
+// State is the state of a tracked job.
+type State int
+
+const (
+	// Pending jobs are waiting in their queue to be delivered.
+	Pending State = iota
+	// Delayed jobs were published with a delay that has not passed yet.
+	Delayed
+	// Running jobs were delivered and are being handled.
+	Running
+	// Succeeded jobs were acknowledged.
+	Succeeded
+	// Failed jobs were rejected by their handler without requeuing them.
+	Failed
+	// Buried jobs were buried or sent to the dead-letter queue because their
+	// leases expired too many times.
+	Buried
+	// Canceled jobs were removed from their queue before finishing.
+	Canceled
+)
+
+// String returns the name of the State.
+func (s State) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Delayed:
+		return "delayed"
+	case Running:
+		return "running"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Buried:
+		return "buried"
+	case Canceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// Done returns true for the final states: Succeeded, Failed, Buried and
+// Canceled.
+func (s State) Done() bool {
+	return s == Succeeded || s == Failed || s == Buried || s == Canceled
+}
+
+// Record is the tracked state of a job.
+type Record struct {
+	// ID is the ID of the job.
+	ID string
+	// Queue is the name of the queue of the job.
+	Queue string
+	State State
+	// Result is the result stored by the handler of the job, encoded with
+	// the codec of the jobs.
+	Result []byte
+	// Error is the error stored by the handler of the job.
+	Error string
+	// Progress is the last progress reported by the handler of the job.
+	Progress Progress
+	// Updated is the last time the record changed.
+	Updated time.Time
+	// Expires is the time the record is deleted, zero if it never expires.
+	Expires time.Time
+}
+
+// Progress is the progress of a job reported by its handler.
+type Progress struct {
+	// Percent is the percent of the job completed, from 0 to 100.
+	Percent float64
+	// Message is the status message of the job.
+	Message string
+	// Time is the time the progress was reported.
+	Time time.Time
+}
+
+// Decode decodes the Result of the record into the given value.
+func (r *Record) Decode(v interface{}) error {
+	return (&mq.Job{Raw: r.Result}).Decode(v)
+}
+
+// Expired returns true if the record expired at the given time.
+func (r *Record) Expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// Tracker records the state and results of the jobs in a Store.
+type Tracker struct {
+	s            Store
+	ttl          time.Duration
+	pollInterval time.Duration
+	topic        mq.Topic
+
+	mu sync.Mutex
+	// changed is closed and replaced every time a record changes.
+	changed chan struct{}
+}
+
+// DefaultPollInterval is how often Wait checks the Store for changes made
+// by other processes.
+const DefaultPollInterval = time.Second
+
+// New returns a Tracker keeping the records in the given Store. The records of
+// the finished jobs are deleted after the ttl, use 0 to keep them forever.
+func New(s Store, ttl time.Duration) *Tracker {
+	return &Tracker{
+		s:            s,
+		ttl:          ttl,
+		pollInterval: DefaultPollInterval,
+		changed:      make(chan struct{}),
+	}
+}
+
+// SetPollInterval sets how often Wait checks the Store for changes made by
+// other processes. The changes made by the Tracker itself are noticed
+// immediately.
+func (t *Tracker) SetPollInterval(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pollInterval = d
+}
+
+// SetTopic sets the topic the reported progress is published to, besides
+// being stored. Every progress is published as a job with the Progress as
+// payload and the ID of the job in the JobIDHeader header.
+func (t *Tracker) SetTopic(topic mq.Topic) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.topic = topic
+}
+
+// OnEvent implements the mq.Hook interface. The errors of the Store are
+// ignored, the hooks can't fail. The jobs of the dead-letter queues are not
+// tracked, they stay buried.
+func (t *Tracker) OnEvent(e mq.Event) {
+	if e.Job == nil || e.Job.DeadLetterOrigin != "" {
+		return
+	}
+
+	var state State
+	switch e.Transition {
+	case mq.Published:
+		if e.Err != nil {
+			return
+		}
+
+		state = Pending
+		if e.Delay > 0 {
+			state = Delayed
+		}
+	case mq.Delivered:
+		state = Running
+	case mq.Acked:
+		if e.Err != nil {
+			return
+		}
+
+		state = Succeeded
+	case mq.Rejected:
+		switch {
+		case e.Requeue && (e.Err == nil || mq.ErrLeaseExpired.Is(e.Err)):
+			state = Pending
+		case !e.Requeue && e.Err == nil:
+			state = Failed
+		default:
+			// the expired jobs not requeued are buried next
+			return
+		}
+	case mq.Buried:
+		// the jobs rejected by their handler stay failed
+		if e.Err == nil {
+			return
+		}
+
+		state = Buried
+	case mq.Canceled:
+		state = Canceled
+	default:
+		return
+	}
+
+	t.update(e.Job.ID, func(r *Record) {
+		r.Queue = e.Queue
+		r.State = state
+	})
+}
+
+// update applies fn to the record of the job, creating it if it doesn't
+// exist, and stores it.
+func (t *Tracker) update(id string, fn func(*Record)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, err := t.s.Get(id)
+	if ErrNotFound.Is(err) {
+		r, err = &Record{ID: id}, nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fn(r)
+	r.Updated = time.Now()
+	r.Expires = time.Time{}
+	if t.ttl > 0 && r.State.Done() {
+		r.Expires = r.Updated.Add(t.ttl)
+	}
+
+	if err := t.s.Put(r); err != nil {
+		return err
+	}
+
+	close(t.changed)
+	t.changed = make(chan struct{})
+	return nil
+}
+
+// SetResult stores the result of the job, encoded with the codec of the jobs.
+// It is meant to be called by the handler before acknowledging the job.
+func (t *Tracker) SetResult(j *mq.Job, v interface{}) error {
+	var enc mq.Job
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+
+	return t.update(j.ID, func(r *Record) {
+		r.Result = enc.Raw
+	})
+}
+
+// SetError stores the error of the job. It is meant to be called by the
+// handler before rejecting the job.
+func (t *Tracker) SetError(j *mq.Job, err error) error {
+	return t.update(j.ID, func(r *Record) {
+		r.Error = err.Error()
+	})
+}
+
+// Progress returns the last progress reported for the job with the given ID,
+// or ErrNotFound.
+func (t *Tracker) Progress(id string) (Progress, error) {
+	r, err := t.s.Get(id)
+	if err != nil {
+		return Progress{}, err
+	}
+
+	return r.Progress, nil
+}
+
+// reportProgress stores the progress of the job and publishes it to the
+// progress topic, if any.
+func (t *Tracker) reportProgress(id string, percent float64, message string) error {
+	if percent < 0 || percent > 100 {
+		return ErrInvalidProgress.New(percent)
+	}
+
+	p := Progress{Percent: percent, Message: message, Time: time.Now()}
+	if err := t.update(id, func(r *Record) { r.Progress = p }); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	topic := t.topic
+	t.mu.Unlock()
+	if topic == nil {
+		return nil
+	}
+
+	j := mq.NewJob()
+	j.Headers = map[string]string{JobIDHeader: id}
+	if err := j.Encode(p); err != nil {
+		return err
+	}
+
+	return topic.Publish(j)
+}
+
+// Wrap returns a JobIter whose jobs report their progress to the Tracker,
+// through Job.ReportProgress or mq.ReportProgress.
+func (t *Tracker) Wrap(iter mq.JobIter) mq.JobIter {
+	return &jobIter{JobIter: iter, t: t}
+}
+
+type jobIter struct {
+	mq.JobIter
+	t *Tracker
+}
+
+// Next implements the mq.JobIter interface.
+func (i *jobIter) Next() (*mq.Job, error) {
+	j, err := i.JobIter.Next()
+	if err != nil || j == nil {
+		return j, err
+	}
+
+	j.Acknowledger = mq.WrapAcknowledger(j.Acknowledger,
+		&acknowledger{Acknowledger: j.Acknowledger, t: i.t, id: j.ID})
+
+	return j, nil
+}
+
+type acknowledger struct {
+	mq.Acknowledger
+	t  *Tracker
+	id string
+}
+
+// ReportProgress implements the mq.ProgressReporter interface.
+func (a *acknowledger) ReportProgress(percent float64, message string) error {
+	return a.t.reportProgress(a.id, percent, message)
+}
+
+// Get returns the record of the job with the given ID, or ErrNotFound.
+func (t *Tracker) Get(id string) (*Record, error) {
+	return t.s.Get(id)
+}
+
+// Wait blocks until the job with the given ID is done, returning its record,
+// or until the context is cancelled. The job does not need to be tracked yet.
+func (t *Tracker) Wait(ctx context.Context, id string) (*Record, error) {
+	for {
+		t.mu.Lock()
+		changed := t.changed
+		interval := t.pollInterval
+		t.mu.Unlock()
+
+		r, err := t.s.Get(id)
+		if err != nil && !ErrNotFound.Is(err) {
+			return nil, err
+		}
+
+		if err == nil && r.State.Done() {
+			return r, nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+
+		timer.Stop()
+	}
+}
@@ -0,0 +1,287 @@
+package results
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+	"github.com/go-mq/mq/v2/poison"
+	"github.com/go-mq/mq/v2/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker(t *testing.T) {
+	require := require.New(t)
+
+	tracker := New(NewMemoryStore(), time.Minute)
+	q, err := mq.AddHook(memory.New(), tracker).Queue("results")
+	require.NoError(err)
+
+	j := test.NewJob(t, true)
+	require.NoError(q.Publish(j))
+	requireState(t, tracker, j.ID, Pending)
+
+	type result struct {
+		waited *Record
+		err    error
+	}
+
+	id := j.ID
+	done := make(chan result)
+	go func() {
+		r, err := tracker.Wait(context.Background(), id)
+		done <- result{r, err}
+	}()
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err = iter.Next()
+	require.NoError(err)
+	requireState(t, tracker, j.ID, Running)
+
+	require.NoError(tracker.SetResult(j, "done"))
+	require.NoError(j.Ack())
+
+	res := <-done
+	require.NoError(res.err)
+	require.Equal(Succeeded, res.waited.State)
+	require.Equal("results", res.waited.Queue)
+	require.False(res.waited.Expires.IsZero())
+
+	var payload string
+	require.NoError(res.waited.Decode(&payload))
+	require.Equal("done", payload)
+
+	// rejected by the handler
+	require.NoError(q.Publish(test.NewJob(t, true)))
+	j, err = iter.Next()
+	require.NoError(err)
+
+	require.NoError(j.Reject(true))
+	requireState(t, tracker, j.ID, Pending)
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.NoError(tracker.SetError(j, errors.New("failure")))
+	require.NoError(j.Reject(false))
+
+	r, err := tracker.Wait(context.Background(), j.ID)
+	require.NoError(err)
+	require.Equal(Failed, r.State)
+	require.Equal("failure", r.Error)
+}
+
+func TestTracker_delayed_buried(t *testing.T) {
+	require := require.New(t)
+
+	tracker := New(NewMemoryStore(), 0)
+	q, err := mq.AddHook(memory.New(), tracker).Queue("results-buried")
+	require.NoError(err)
+	require.NoError(q.(mq.DeadLetterer).SetDeadLetter(mq.DeadLetterPolicy{
+		Queue:         "results-dead",
+		MaxDeliveries: 1,
+	}))
+
+	j := test.NewJob(t, true)
+	require.NoError(q.PublishDelayed(j, 10*time.Millisecond))
+	requireState(t, tracker, j.ID, Delayed)
+
+	iter, err := q.(*memory.Queue).ConsumeWithVisibility(0, 10*time.Millisecond)
+	require.NoError(err)
+	defer iter.Close()
+
+	_, err = iter.Next()
+	require.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	r, err := tracker.Wait(ctx, j.ID)
+	require.NoError(err)
+	require.Equal(Buried, r.State)
+	require.True(r.Expires.IsZero())
+}
+
+func TestTracker_canceled(t *testing.T) {
+	require := require.New(t)
+
+	tracker := New(NewMemoryStore(), 0)
+	q, err := mq.AddHook(memory.New(), tracker).Queue("results-canceled")
+	require.NoError(err)
+
+	pending, leased := test.NewJob(t, true), test.NewJob(t, true)
+	require.NoError(q.Publish(leased))
+	require.NoError(q.Publish(pending))
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err := iter.Next()
+	require.NoError(err)
+
+	for _, id := range []string{pending.ID, leased.ID} {
+		ok, err := mq.Cancel(q, id)
+		require.NoError(err)
+		require.True(ok)
+	}
+
+	requireState(t, tracker, pending.ID, Canceled)
+	requireState(t, tracker, leased.ID, Running)
+
+	// the leased job is canceled once it's discarded
+	require.NoError(j.Reject(true))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	r, err := tracker.Wait(ctx, leased.ID)
+	require.NoError(err)
+	require.Equal(Canceled, r.State)
+}
+
+func TestTracker_Wait_cancel(t *testing.T) {
+	require := require.New(t)
+
+	tracker := New(NewMemoryStore(), 0)
+	tracker.SetPollInterval(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := tracker.Wait(ctx, "unknown")
+	require.Equal(context.DeadlineExceeded, err)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "results")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir)
+	require.NoError(err)
+	testStore(t, s)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(err)
+	require.Len(files, 1)
+}
+
+func testStore(t *testing.T, s Store) {
+	require := require.New(t)
+
+	_, err := s.Get("a/b")
+	require.True(ErrNotFound.Is(err))
+
+	now := time.Now().Round(0)
+	require.NoError(s.Put(&Record{
+		ID:      "a/b",
+		Queue:   "q",
+		State:   Succeeded,
+		Result:  []byte{1, 2},
+		Updated: now,
+	}))
+
+	r, err := s.Get("a/b")
+	require.NoError(err)
+	require.Equal("a/b", r.ID)
+	require.Equal(Succeeded, r.State)
+	require.Equal([]byte{1, 2}, r.Result)
+	require.True(now.Equal(r.Updated))
+
+	require.NoError(s.Put(&Record{ID: "expired", Expires: now}))
+	_, err = s.Get("expired")
+	require.True(ErrNotFound.Is(err))
+
+	require.NoError(s.Put(&Record{ID: "deleted"}))
+	require.NoError(s.Delete("deleted"))
+	_, err = s.Get("deleted")
+	require.True(ErrNotFound.Is(err))
+
+	require.NoError(s.Purge())
+	_, err = s.Get("a/b")
+	require.NoError(err)
+}
+
+func requireState(t *testing.T, tracker *Tracker, id string, state State) {
+	t.Helper()
+	r, err := tracker.Get(id)
+	require.NoError(t, err)
+	require.Equal(t, state, r.State)
+}
+
+func TestTracker_progress(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.New()
+	topic, err := b.(mq.TopicBroker).Topic("progress")
+	require.NoError(err)
+	sub, err := topic.Subscribe("ui", false)
+	require.NoError(err)
+	defer sub.Close()
+
+	tracker := New(NewMemoryStore(), 0)
+	tracker.SetTopic(topic)
+	q, err := mq.AddHook(b, tracker).Queue("results-progress")
+	require.NoError(err)
+
+	j := test.NewJob(t, true)
+	require.NoError(q.Publish(j))
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	// the progress is reported through the wrappers stacked on top
+	j, err = poison.New(poison.Policy{}).Wrap(tracker.Wrap(iter)).Next()
+	require.NoError(err)
+	require.True(j.CanExtend())
+
+	require.NoError(j.ReportProgress(25, "fetching"))
+	p, err := tracker.Progress(j.ID)
+	require.NoError(err)
+	require.Equal(25.0, p.Percent)
+	require.Equal("fetching", p.Message)
+
+	ctx := mq.ContextWithJob(context.Background(), j)
+	require.NoError(mq.ReportProgress(ctx, 50, "parsing"))
+	require.True(ErrInvalidProgress.Is(mq.ReportProgress(ctx, 101, "")))
+
+	r, err := tracker.Get(j.ID)
+	require.NoError(err)
+	require.Equal(Running, r.State)
+	require.Equal(50.0, r.Progress.Percent)
+	require.Equal("parsing", r.Progress.Message)
+
+	subIter, err := sub.Consume(0)
+	require.NoError(err)
+	defer subIter.Close()
+
+	for _, expected := range []string{"fetching", "parsing"} {
+		pj, err := subIter.Next()
+		require.NoError(err)
+		require.Equal(j.ID, pj.Headers[JobIDHeader])
+
+		var p Progress
+		require.NoError(pj.Decode(&p))
+		require.Equal(expected, p.Message)
+		require.NoError(pj.Ack())
+	}
+
+	require.NoError(j.Ack())
+	_, err = tracker.Progress("unknown")
+	require.True(ErrNotFound.Is(err))
+}
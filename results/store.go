@@ -0,0 +1,208 @@
+package results
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Store keeps the records of the jobs, keyed by Job.ID.
+type Store interface {
+	// Get returns the record of the given job, or ErrNotFound if there is
+	// none or it expired.
+	Get(id string) (*Record, error)
+	// Put stores the record, replacing the previous one.
+	Put(*Record) error
+	// Delete deletes the record of the given job.
+	Delete(id string) error
+	// Purge deletes the expired records.
+	Purge() error
+}
+
+// NewMemoryStore returns a Store keeping the records in memory. The expired
+// records are purged as new records are stored.
+func NewMemoryStore() Store {
+	return &memoryStore{records: make(map[string]*Record)}
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	records map[string]*Record
+	// puts counts the records stored since the last purge.
+	puts int
+}
+
+// Get implements the Store interface.
+func (s *memoryStore) Get(id string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[id]
+	if !ok || r.Expired(time.Now()) {
+		return nil, ErrNotFound.New(id)
+	}
+
+	c := *r
+	return &c, nil
+}
+
+// Put implements the Store interface.
+func (s *memoryStore) Put(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := *r
+	s.records[r.ID] = &c
+
+	s.puts++
+	if s.puts > len(s.records) {
+		s.purge()
+	}
+
+	return nil
+}
+
+// Delete implements the Store interface.
+func (s *memoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, id)
+	return nil
+}
+
+// Purge implements the Store interface.
+func (s *memoryStore) Purge() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge()
+	return nil
+}
+
+func (s *memoryStore) purge() {
+	now := time.Now()
+	for id, r := range s.records {
+		if r.Expired(now) {
+			delete(s.records, id)
+		}
+	}
+
+	s.puts = 0
+}
+
+// FileStore is a Store keeping every record in its own file of a directory,
+// so it can be shared by the processes of a host.
+type FileStore struct {
+	dir string
+}
+
+const recordExt = ".record"
+
+// NewFileStore returns a FileStore keeping the records in the given
+// directory, which is created if it doesn't exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, url.PathEscape(id)+recordExt)
+}
+
+// Get implements the Store interface.
+func (s *FileStore) Get(id string) (*Record, error) {
+	data, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound.New(id)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var r Record
+	if err := msgpack.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+
+	if r.Expired(time.Now()) {
+		return nil, ErrNotFound.New(id)
+	}
+
+	return &r, nil
+}
+
+// Put implements the Store interface. The file is replaced atomically, so
+// readers never see a partial record.
+func (s *FileStore) Put(r *Record) error {
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(r.ID))
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// Delete implements the Store interface.
+func (s *FileStore) Delete(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Purge implements the Store interface.
+func (s *FileStore) Purge() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, recordExt) {
+			continue
+		}
+
+		id, err := url.PathUnescape(strings.TrimSuffix(name, recordExt))
+		if err != nil {
+			continue
+		}
+
+		if _, err := s.Get(id); ErrNotFound.Is(err) {
+			if err := s.Delete(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,309 @@
+// Package rpc implements synchronous request/reply calls over queues. The
+// requests are published to a regular queue and the replies are sent back to
+// a reply queue owned by the client, matched by a correlation ID. It only
+// relies on the mq.Broker and mq.Queue interfaces, so it works on every
+// backend.
+package rpc
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/google/uuid"
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+const (
+	// CorrelationIDHeader is the header matching a reply with its request.
+	CorrelationIDHeader = "correlation-id"
+	// ReplyToHeader is the header with the name of the queue the reply of a
+	// request must be published to.
+	ReplyToHeader = "reply-to"
+	// ErrorHeader is the header with the error returned by the Handler, set
+	// only in failed replies.
+	ErrorHeader = "rpc-error"
+)
+
+// ErrRemote is the error returned by Call when the Handler of the request
+// failed.
+var ErrRemote = errors.NewKind("remote error: %s")
+
+// Client makes calls to the Servers listening in the queues of a Broker.
+type Client struct {
+	b       mq.Broker
+	replyTo string
+	iter    mq.JobIter
+
+	mu      sync.Mutex
+	pending map[string]chan *mq.Job
+	done    chan struct{}
+}
+
+// NewClient returns a new Client using the given Broker, with its own reply
+// queue.
+func NewClient(b mq.Broker) (*Client, error) {
+	replyTo := "rpc.reply." + uuid.New().String()
+	q, err := b.Queue(replyTo)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := q.Consume(0)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		b:       b,
+		replyTo: replyTo,
+		iter:    iter,
+		pending: make(map[string]chan *mq.Job),
+		done:    make(chan struct{}),
+	}
+
+	go c.dispatch()
+	return c, nil
+}
+
+// Call publishes a request with the given payload to the queue and waits for
+// its reply until the context is done.
+func (c *Client) Call(ctx context.Context, queue string, payload interface{}) (*mq.Job, error) {
+	select {
+	case <-c.done:
+		return nil, mq.ErrAlreadyClosed.New()
+	default:
+	}
+
+	q, err := c.b.Queue(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	req := mq.NewJob()
+	if err := req.Encode(payload); err != nil {
+		return nil, err
+	}
+
+	req.Headers = map[string]string{
+		CorrelationIDHeader: req.ID,
+		ReplyToHeader:       c.replyTo,
+	}
+
+	reply := make(chan *mq.Job, 1)
+	c.mu.Lock()
+	c.pending[req.ID] = reply
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := q.Publish(req); err != nil {
+		return nil, err
+	}
+
+	select {
+	case j := <-reply:
+		if msg, ok := j.Headers[ErrorHeader]; ok {
+			return nil, ErrRemote.New(msg)
+		}
+
+		return j, nil
+	case <-c.done:
+		return nil, mq.ErrAlreadyClosed.New()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dispatch delivers the replies to the pending calls, the replies of calls
+// that are not waiting anymore, and the duplicated replies, are dropped.
+func (c *Client) dispatch() {
+	defer close(c.done)
+	for {
+		j, err := c.iter.Next()
+		if err != nil {
+			return
+		}
+
+		if j == nil {
+			continue
+		}
+
+		c.mu.Lock()
+		reply, ok := c.pending[j.Headers[CorrelationIDHeader]]
+		c.mu.Unlock()
+
+		if ok {
+			select {
+			case reply <- j:
+			default:
+				// the call already got its reply
+			}
+		}
+
+		j.Ack()
+	}
+}
+
+// Close closes the Client, the calls in progress return
+// mq.ErrAlreadyClosed. The reply queue is deleted if the Broker implements
+// mq.QueueDeleter.
+func (c *Client) Close() error {
+	err := c.iter.Close()
+	<-c.done
+	if err != nil {
+		return err
+	}
+
+	err = mq.DeleteQueue(c.b, c.replyTo)
+	if mq.ErrDeleteQueueNotSupported.Is(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Handler handles a request, returning the payload of its reply.
+type Handler func(ctx context.Context, req *mq.Job) (interface{}, error)
+
+// Server handles the requests published to a queue.
+type Server struct {
+	b mq.Broker
+	h Handler
+}
+
+// NewServer returns a new Server handling requests with the given Handler.
+func NewServer(b mq.Broker, h Handler) *Server {
+	return &Server{b: b, h: h}
+}
+
+// Serve handles the requests published to the queue until the context is
+// done, running up to concurrency handlers at the same time. The requests
+// whose reply can't be published are requeued. Once the context is done, the
+// requests in progress are allowed to finish before Serve returns.
+func (s *Server) Serve(ctx context.Context, queue string, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	q, err := s.b.Queue(queue)
+	if err != nil {
+		return err
+	}
+
+	iter, err := q.Consume(concurrency)
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		j   *mq.Job
+		err error
+	}
+
+	next := make(chan result)
+	stop := make(chan struct{})
+	go func() {
+		defer close(next)
+		for {
+			j, err := iter.Next()
+			select {
+			case next <- result{j, err}:
+			case <-stop:
+				// the server is shutting down, leave the job for others
+				if j != nil {
+					j.Reject(true)
+				}
+
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// the iterator is closed only once the handlers are done, closing it
+	// before would requeue the requests still being handled.
+	var wg sync.WaitGroup
+	shutdown := func() error {
+		close(stop)
+		wg.Wait()
+		err := iter.Close()
+		for range next {
+		}
+
+		if mq.ErrAlreadyClosed.Is(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	for {
+		select {
+		case r := <-next:
+			if r.err != nil {
+				shutdown()
+				if r.err == io.EOF || mq.ErrAlreadyClosed.Is(r.err) {
+					return nil
+				}
+
+				return r.err
+			}
+
+			if r.j == nil {
+				continue
+			}
+
+			wg.Add(1)
+			go func(j *mq.Job) {
+				defer wg.Done()
+				if err := s.handle(ctx, j); err != nil {
+					j.Reject(true)
+					return
+				}
+
+				j.Ack()
+			}(r.j)
+		case <-ctx.Done():
+			return shutdown()
+		}
+	}
+}
+
+func (s *Server) handle(ctx context.Context, req *mq.Job) error {
+	payload, err := s.h(ctx, req)
+
+	replyTo, ok := req.Headers[ReplyToHeader]
+	if !ok {
+		return nil
+	}
+
+	reply := mq.NewJob()
+	reply.Headers = map[string]string{
+		CorrelationIDHeader: req.Headers[CorrelationIDHeader],
+	}
+
+	if err != nil {
+		reply.Headers[ErrorHeader] = err.Error()
+		payload = err.Error()
+	}
+
+	if err := reply.Encode(payload); err != nil {
+		return err
+	}
+
+	q, err := s.b.Queue(replyTo)
+	if err != nil {
+		return err
+	}
+
+	return q.Publish(reply)
+}
@@ -0,0 +1,213 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCall(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.New()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := NewServer(b, func(_ context.Context, req *mq.Job) (interface{}, error) {
+			var n int
+			if err := req.Decode(&n); err != nil {
+				return nil, err
+			}
+
+			if n < 0 {
+				return nil, fmt.Errorf("negative number")
+			}
+
+			return n * 2, nil
+		}).Serve(ctx, "double", 4)
+		assert.NoError(t, err)
+	}()
+
+	c, err := NewClient(b)
+	require.NoError(err)
+
+	var calls sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		calls.Add(1)
+		go func(i int) {
+			defer calls.Done()
+			reply, err := c.Call(context.Background(), "double", i)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var n int
+			assert.NoError(t, reply.Decode(&n))
+			assert.Equal(t, i*2, n)
+		}(i)
+	}
+	calls.Wait()
+
+	_, err = c.Call(context.Background(), "double", -1)
+	require.True(ErrRemote.Is(err))
+	require.Contains(err.Error(), "negative number")
+
+	require.NoError(c.Close())
+	_, err = c.Call(context.Background(), "double", 1)
+	require.True(mq.ErrAlreadyClosed.Is(err))
+
+	cancel()
+	wg.Wait()
+}
+
+func TestCall_timeout(t *testing.T) {
+	require := require.New(t)
+
+	c, err := NewClient(memory.New())
+	require.NoError(err)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = c.Call(ctx, "nobody-listening", "hello")
+	require.Equal(context.DeadlineExceeded, err)
+}
+
+func TestCall_duplicateReply(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.New()
+	q, err := b.Queue("echo")
+	require.NoError(err)
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	// a server replying twice to every request
+	go func() {
+		for {
+			req, err := iter.Next()
+			if err != nil {
+				return
+			}
+
+			replies, err := b.Queue(req.Headers[ReplyToHeader])
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			for i := 0; i < 2; i++ {
+				reply := mq.NewJob()
+				reply.Headers = map[string]string{
+					CorrelationIDHeader: req.Headers[CorrelationIDHeader],
+				}
+
+				assert.NoError(t, reply.Encode(i))
+				assert.NoError(t, replies.Publish(reply))
+			}
+
+			assert.NoError(t, req.Ack())
+		}
+	}()
+
+	c, err := NewClient(b)
+	require.NoError(err)
+	defer c.Close()
+
+	// the duplicated reply does not block the replies of the next calls; the
+	// memory iterators poll the empty queues every second
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		reply, err := c.Call(ctx, "echo", i)
+		cancel()
+		require.NoError(err)
+
+		var n int
+		require.NoError(reply.Decode(&n))
+		require.Equal(0, n)
+	}
+}
+
+func TestServe_shutdown(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.New()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var handled int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- NewServer(b, func(_ context.Context, req *mq.Job) (interface{}, error) {
+			if atomic.AddInt32(&handled, 1) == 1 {
+				close(started)
+			}
+
+			<-release
+			return "done", nil
+		}).Serve(ctx, "slow", 1)
+	}()
+
+	c, err := NewClient(b)
+	require.NoError(err)
+	defer c.Close()
+
+	replies := make(chan error, 1)
+	go func() {
+		callCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := c.Call(callCtx, "slow", 1)
+		replies <- err
+	}()
+
+	// give the server time to react to the shutdown while the request is
+	// still being handled
+	<-started
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	require.NoError(<-served)
+	require.NoError(<-replies)
+	require.Equal(int32(1), atomic.LoadInt32(&handled))
+
+	q, err := b.Queue("slow")
+	require.NoError(err)
+	stats, err := q.(mq.Inspector).Stats()
+	require.NoError(err)
+	require.Equal(mq.QueueStats{}, stats)
+}
+
+type deleteBroker struct {
+	mq.Broker
+	deleted []string
+}
+
+func (b *deleteBroker) DeleteQueue(name string) error {
+	b.deleted = append(b.deleted, name)
+	return mq.DeleteQueue(b.Broker, name)
+}
+
+func TestClient_Close(t *testing.T) {
+	require := require.New(t)
+
+	b := &deleteBroker{Broker: memory.New()}
+	c, err := NewClient(b)
+	require.NoError(err)
+	require.NoError(c.Close())
+	require.Equal([]string{c.replyTo}, b.deleted)
+}
@@ -0,0 +1,25 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/go-mq/mq/v2"
+
+	"github.com/stretchr/testify/require"
+)
+
+// NewJob returns a new job with the given payload, failing the test if it
+// cannot be encoded.
+func NewJob(t testing.TB, payload interface{}) *mq.Job {
+	j := mq.NewJob()
+	require.NoError(t, j.Encode(payload))
+	return j
+}
+
+// Publish publishes a new job to the queue for every payload, failing the
+// test if any of them cannot be published.
+func Publish(t testing.TB, q mq.Queue, payloads ...interface{}) {
+	for _, payload := range payloads {
+		require.NoError(t, q.Publish(NewJob(t, payload)))
+	}
+}
@@ -26,6 +26,7 @@ func NewName() string {
 	return fmt.Sprintf("queue_tests_%d", testRand.Int())
 }
 
+// QueueSuite tests the queues of the Broker with the given URI.
 type QueueSuite struct {
 	suite.Suite
 	r rand.Rand
@@ -195,6 +196,80 @@ func (s *QueueSuite) TestJob_Reject_requeue() {
 	assert.NoError(iter.Close())
 }
 
+func (s *QueueSuite) TestJob_Reject_requeue_redelivered() {
+	assert := assert.New(s.T())
+
+	qName := NewName()
+	q, err := s.Broker.Queue(qName)
+	assert.NoError(err)
+	assert.NotNil(q)
+
+	j := mq.NewJob()
+	assert.NoError(j.Encode(1))
+	assert.NoError(q.Publish(j))
+
+	advertisedWindow := 1
+	iter, err := q.Consume(advertisedWindow)
+	assert.NoError(err)
+
+	first, err := iter.Next()
+	assert.NoError(err)
+	assert.EqualValues(1, first.Deliveries)
+	assert.False(first.Redelivered)
+	assert.False(first.FirstDelivery.IsZero())
+	assert.Equal(first.FirstDelivery, first.LastDelivery)
+	assert.NoError(first.Reject(true))
+
+	second, err := iter.Next()
+	assert.NoError(err)
+	assert.Equal(first.ID, second.ID)
+	assert.EqualValues(2, second.Deliveries)
+	assert.True(second.Redelivered)
+	assert.True(first.FirstDelivery.Equal(second.FirstDelivery))
+	assert.False(second.LastDelivery.Before(first.LastDelivery))
+	assert.NoError(second.Ack())
+
+	assert.NoError(iter.Close())
+}
+
+func (s *QueueSuite) TestJobIter_Close_requeue() {
+	assert := assert.New(s.T())
+
+	qName := NewName()
+	q, err := s.Broker.Queue(qName)
+	assert.NoError(err)
+	assert.NotNil(q)
+
+	j := mq.NewJob()
+	assert.NoError(j.Encode(1))
+	assert.NoError(q.Publish(j))
+
+	advertisedWindow := 1
+	iter, err := q.Consume(advertisedWindow)
+	assert.NoError(err)
+
+	j, err = iter.Next()
+	assert.NoError(err)
+	assert.NotNil(j)
+
+	// closing the iterator puts back the unacknowledged job
+	assert.NoError(iter.Close())
+
+	iter, err = q.Consume(advertisedWindow)
+	assert.NoError(err)
+
+	j, err = iter.Next()
+	assert.NoError(err)
+	if assert.NotNil(j) {
+		var payload int
+		assert.NoError(j.Decode(&payload))
+		assert.Equal(1, payload)
+		assert.NoError(j.Ack())
+	}
+
+	assert.NoError(iter.Close())
+}
+
 func (s *QueueSuite) TestPublish_nil() {
 	assert := assert.New(s.T())
 
@@ -535,6 +610,58 @@ func (s *QueueSuite) TestRetryQueue() {
 	<-done
 }
 
+func (s *QueueSuite) TestDeadLetter() {
+	assert := assert.New(s.T())
+
+	dlqName := NewName()
+	origins := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		qName := NewName()
+		q, err := s.Broker.Queue(qName)
+		assert.NoError(err)
+
+		dl, ok := q.(mq.DeadLetterer)
+		if !ok {
+			s.T().Skip("dead-letter queues not supported")
+		}
+
+		assert.NoError(dl.SetDeadLetter(mq.DeadLetterPolicy{Queue: dlqName}))
+
+		j := mq.NewJob()
+		assert.NoError(j.Encode(i))
+		assert.NoError(q.Publish(j))
+
+		iter, err := q.Consume(1)
+		assert.NoError(err)
+
+		j, err = iter.Next()
+		assert.NoError(err)
+		j.ErrorType = "failed"
+		assert.NoError(j.Reject(false))
+		assert.NoError(iter.Close())
+
+		origins[qName] = true
+	}
+
+	dlq, err := s.Broker.Queue(dlqName)
+	assert.NoError(err)
+
+	iter, err := dlq.Consume(1)
+	assert.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		j, err := iter.Next()
+		assert.NoError(err)
+		assert.True(origins[j.DeadLetterOrigin])
+		assert.Equal(mq.DeadLetterRejected, j.DeadLetterReason)
+		assert.Equal("failed", j.ErrorType)
+		assert.NoError(j.Ack())
+		delete(origins, j.DeadLetterOrigin)
+	}
+
+	assert.NoError(iter.Close())
+}
+
 func (s *QueueSuite) TestConcurrent() {
 	testCases := []int{1, 2, 13, 150}
 
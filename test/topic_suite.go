@@ -0,0 +1,182 @@
+package test
+
+import (
+	"github.com/go-mq/mq/v2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// TopicSuite tests the topics of the Broker with the given URI, it is
+// skipped if the Broker does not implement mq.TopicBroker.
+type TopicSuite struct {
+	suite.Suite
+
+	BrokerURI string
+
+	Broker mq.TopicBroker
+}
+
+func (s *TopicSuite) SetupTest() {
+	b, err := mq.NewBroker(s.BrokerURI)
+	if !s.NoError(err) {
+		s.FailNow(err.Error())
+	}
+
+	tb, ok := b.(mq.TopicBroker)
+	if !ok {
+		s.T().Skip("topics not supported")
+	}
+
+	s.Broker = tb
+}
+
+func (s *TopicSuite) TearDownTest() {
+	if s.Broker != nil {
+		s.NoError(s.Broker.Close())
+	}
+}
+
+func (s *TopicSuite) TestPublish_nil() {
+	assert := assert.New(s.T())
+
+	t, err := s.Broker.Topic(NewName())
+	assert.NoError(err)
+
+	err = t.Publish(nil)
+	assert.True(mq.ErrEmptyJob.Is(err))
+
+	err = t.Publish(&mq.Job{})
+	assert.True(mq.ErrEmptyJob.Is(err))
+}
+
+func (s *TopicSuite) TestPublish_fanout() {
+	assert := assert.New(s.T())
+
+	t, err := s.Broker.Topic(NewName())
+	assert.NoError(err)
+
+	sub1, err := t.Subscribe(NewName(), false)
+	assert.NoError(err)
+	sub2, err := t.Subscribe(NewName(), false)
+	assert.NoError(err)
+
+	j := mq.NewJob()
+	assert.NoError(j.Encode("hello"))
+	assert.NoError(t.Publish(j))
+
+	for _, sub := range []mq.Subscription{sub1, sub2} {
+		iter, err := sub.Consume(1)
+		assert.NoError(err)
+
+		j, err := iter.Next()
+		assert.NoError(err)
+
+		var payload string
+		assert.NoError(j.Decode(&payload))
+		assert.Equal("hello", payload)
+		assert.NoError(j.Ack())
+
+		assert.NoError(iter.Close())
+		assert.NoError(sub.Close())
+	}
+}
+
+func (s *TopicSuite) TestSubscription_independent_acks() {
+	assert := assert.New(s.T())
+
+	t, err := s.Broker.Topic(NewName())
+	assert.NoError(err)
+
+	sub1, err := t.Subscribe(NewName(), false)
+	assert.NoError(err)
+	sub2, err := t.Subscribe(NewName(), false)
+	assert.NoError(err)
+
+	j := mq.NewJob()
+	assert.NoError(j.Encode(1))
+	assert.NoError(t.Publish(j))
+
+	iter1, err := sub1.Consume(1)
+	assert.NoError(err)
+	iter2, err := sub2.Consume(1)
+	assert.NoError(err)
+
+	j1, err := iter1.Next()
+	assert.NoError(err)
+	assert.NoError(j1.Reject(true))
+
+	j2, err := iter2.Next()
+	assert.NoError(err)
+	assert.EqualValues(1, j2.Deliveries)
+	assert.NoError(j2.Ack())
+
+	// the job rejected in the first subscription is redelivered only there
+	j1, err = iter1.Next()
+	assert.NoError(err)
+	assert.True(j1.Redelivered)
+	assert.NoError(j1.Ack())
+
+	assert.NoError(iter1.Close())
+	assert.NoError(iter2.Close())
+}
+
+func (s *TopicSuite) TestSubscription_durable() {
+	assert := assert.New(s.T())
+
+	t, err := s.Broker.Topic(NewName())
+	assert.NoError(err)
+
+	durable, ephemeral := NewName(), NewName()
+	sub, err := t.Subscribe(durable, true)
+	assert.NoError(err)
+	assert.True(sub.Durable())
+	assert.Equal(durable, sub.Name())
+	assert.NoError(sub.Close())
+
+	sub, err = t.Subscribe(ephemeral, false)
+	assert.NoError(err)
+	assert.False(sub.Durable())
+	assert.NoError(sub.Close())
+
+	j := mq.NewJob()
+	assert.NoError(j.Encode("while closed"))
+	assert.NoError(t.Publish(j))
+
+	// the durable subscription received the job while closed
+	_, err = t.Subscribe(durable, false)
+	assert.True(mq.ErrDurabilityMismatch.Is(err))
+	sub, err = t.Subscribe(durable, true)
+	assert.NoError(err)
+
+	iter, err := sub.Consume(1)
+	assert.NoError(err)
+
+	j, err = iter.Next()
+	assert.NoError(err)
+	var payload string
+	assert.NoError(j.Decode(&payload))
+	assert.Equal("while closed", payload)
+	assert.NoError(j.Ack())
+	assert.NoError(iter.Close())
+	assert.NoError(sub.Unsubscribe())
+
+	// the ephemeral one was deleted, so it starts empty
+	sub, err = t.Subscribe(ephemeral, false)
+	assert.NoError(err)
+
+	iter, err = sub.Consume(1)
+	assert.NoError(err)
+
+	done := make(chan struct{})
+	go func() {
+		j, err := iter.Next()
+		assert.True(mq.ErrAlreadyClosed.Is(err))
+		assert.Nil(j)
+		close(done)
+	}()
+
+	assert.NoError(iter.Close())
+	<-done
+	assert.NoError(sub.Close())
+}
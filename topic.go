@@ -0,0 +1,43 @@
+package mq
+
+import "gopkg.in/src-d/go-errors.v1"
+
+// ErrDurabilityMismatch is the error returned when subscribing with an
+// existing subscription name and a different durability.
+var ErrDurabilityMismatch = errors.NewKind("subscription %s already exists with a different durability")
+
+// TopicBroker is implemented by the Brokers supporting publish/subscribe
+// topics on top of their queues.
+type TopicBroker interface {
+	Broker
+	// Topic returns the Topic from the Broker with the given name.
+	Topic(string) (Topic, error)
+}
+
+// Topic represents a publish/subscribe topic. Every job published to a Topic
+// is delivered to all of its subscriptions.
+type Topic interface {
+	// Publish publishes a copy of the given Job to every subscription.
+	Publish(*Job) error
+	// Subscribe returns the Subscription with the given name, creating it if
+	// it does not exist. A durable Subscription keeps receiving jobs after
+	// being closed, until Unsubscribe is called, while an ephemeral one is
+	// deleted as soon as it is closed. It returns ErrDurabilityMismatch if
+	// the Subscription exists with a different durability.
+	Subscribe(name string, durable bool) (Subscription, error)
+}
+
+// Subscription represents a subscription to a Topic. It is consumed as a
+// regular Queue, so its jobs are acknowledged independently of the jobs of
+// any other Subscription.
+type Subscription interface {
+	Queue
+	// Name returns the name of the Subscription.
+	Name() string
+	// Durable returns true if the Subscription survives being closed.
+	Durable() bool
+	// Unsubscribe deletes the Subscription, dropping its pending jobs.
+	Unsubscribe() error
+	// Close closes the Subscription, deleting it if it is ephemeral.
+	Close() error
+}
@@ -0,0 +1,214 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// Names of the job headers carrying the trace context, as defined by the W3C
+// Trace Context specification.
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+// ErrInvalidTraceparent is returned when a traceparent can't be parsed.
+var ErrInvalidTraceparent = errors.NewKind("invalid traceparent: %s")
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// IsValid returns true if the TraceID is not all zeros.
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+// String returns the hex encoding of the TraceID.
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// IsValid returns true if the SpanID is not all zeros.
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// String returns the hex encoding of the SpanID.
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// FlagSampled is the trace flag set when the caller may have recorded the
+// trace.
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span propagated across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Flags are the trace flags, such as FlagSampled.
+	Flags byte
+	// State is the vendor specific tracestate, propagated untouched.
+	State string
+}
+
+// IsValid returns true if both the TraceID and the SpanID are valid.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent returns the SpanContext in the traceparent format.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent parses a traceparent of version 00 or of any later version,
+// ignoring the fields it doesn't know about.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return sc, ErrInvalidTraceparent.New(s)
+	}
+
+	var version, flags [1]byte
+	if err := decodeHex(version[:], parts[0]); err != nil {
+		return sc, ErrInvalidTraceparent.New(s)
+	}
+
+	if decodeHex(sc.TraceID[:], parts[1]) != nil ||
+		decodeHex(sc.SpanID[:], parts[2]) != nil ||
+		decodeHex(flags[:], parts[3]) != nil || !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent.New(s)
+	}
+
+	sc.Flags = flags[0]
+	return sc, nil
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return fmt.Errorf("invalid length or case")
+	}
+
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of the context carrying the given
+// SpanContext, which becomes the parent of the spans started from it.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the SpanContext carried by the context, if
+// any.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Inject writes the SpanContext carried by the context in the headers of the
+// job. Nothing is written if the context carries no SpanContext.
+func Inject(ctx context.Context, j *mq.Job) {
+	if sc, ok := SpanContextFromContext(ctx); ok {
+		inject(sc, j)
+	}
+}
+
+func inject(sc SpanContext, j *mq.Job) {
+	// the map could be shared with other jobs, so it's never modified
+	headers := make(map[string]string, len(j.Headers)+2)
+	for k, v := range j.Headers {
+		headers[k] = v
+	}
+
+	headers[TraceparentHeader] = sc.Traceparent()
+	if sc.State != "" {
+		headers[TracestateHeader] = sc.State
+	} else {
+		delete(headers, TracestateHeader)
+	}
+
+	j.Headers = headers
+}
+
+// Extract returns the SpanContext written in the headers of the job. False is
+// returned if there is none or it's invalid.
+func Extract(j *mq.Job) (SpanContext, bool) {
+	tp, ok := j.Headers[TraceparentHeader]
+	if !ok {
+		return SpanContext{}, false
+	}
+
+	sc, err := ParseTraceparent(tp)
+	if err != nil {
+		return SpanContext{}, false
+	}
+
+	sc.State = j.Headers[TracestateHeader]
+	return sc, true
+}
+
+// Publish publishes the job in the queue as a child of the SpanContext
+// carried by the context. If the queue comes from a Broker returned by New,
+// the producer span is started as a child of it.
+func Publish(ctx context.Context, q mq.Queue, j *mq.Job) error {
+	if j != nil {
+		Inject(ctx, j)
+	}
+
+	return q.Publish(j)
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		randomBytes(id[:])
+	}
+
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		randomBytes(id[:])
+	}
+
+	return id
+}
+
+var (
+	fallbackMu sync.Mutex
+	fallback   = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+)
+
+// randomBytes fills b with random bytes. If crypto/rand fails, a pseudo-random
+// generator is used instead, so the IDs can always be generated.
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err == nil {
+		return
+	}
+
+	fallbackMu.Lock()
+	defer fallbackMu.Unlock()
+	fallback.Read(b)
+}
@@ -0,0 +1,95 @@
+package trace
+
+import (
+	"sync"
+	"time"
+)
+
+// Kind is the role of a span in the messaging operation.
+type Kind int
+
+const (
+	// Producer spans are started when a job is published.
+	Producer Kind = iota
+	// Consumer spans are started when a job is delivered and end when it is
+	// acknowledged or rejected.
+	Consumer
+)
+
+// String returns the name of the Kind.
+func (k Kind) String() string {
+	switch k {
+	case Producer:
+		return "producer"
+	case Consumer:
+		return "consumer"
+	default:
+		return "unknown"
+	}
+}
+
+// Names of the span attributes.
+const (
+	QueueAttribute       = "messaging.destination"
+	JobIDAttribute       = "messaging.message_id"
+	OperationAttribute   = "messaging.operation"
+	DeliveriesAttribute  = "messaging.deliveries"
+	RedeliveredAttribute = "messaging.redelivered"
+	DelayAttribute       = "messaging.delay"
+)
+
+// Span is a finished operation of a trace.
+type Span struct {
+	Name string
+	Kind Kind
+	// Context identifies the span.
+	Context SpanContext
+	// Parent is the span this one is a child of, invalid for root spans.
+	Parent SpanContext
+	// Links are the spans this one is causally related to. The consumer
+	// spans are linked to the producer of the job.
+	Links      []SpanContext
+	Start, End time.Time
+	Attributes map[string]string
+	// Err is the error the operation finished with, if any.
+	Err error
+}
+
+// Exporter receives the spans as they finish. ExportSpan may be called
+// concurrently.
+type Exporter interface {
+	ExportSpan(*Span)
+}
+
+// Recorder is an Exporter keeping the spans in memory, mostly useful for
+// tests.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewRecorder returns an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// ExportSpan implements the Exporter interface.
+func (r *Recorder) ExportSpan(s *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+// Spans returns the recorded spans, in the order they finished.
+func (r *Recorder) Spans() []*Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Span(nil), r.spans...)
+}
+
+// Reset forgets the recorded spans.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = nil
+}
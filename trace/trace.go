@@ -0,0 +1,251 @@
+// Package trace implements the propagation of the W3C Trace Context through
+// the jobs of any mq.Broker, so distributed traces are not lost when the work
+// crosses a queue.
+//
+// The producer span of every published job is written in its traceparent and
+// tracestate headers. When the job is delivered, a consumer span is started as
+// a child of, and linked to, the producer span; it ends when the job is
+// acknowledged or rejected. Redelivered jobs, either delayed or requeued, get
+// a new consumer span every time.
+package trace
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+)
+
+// ResultAttribute is the attribute of the consumer spans telling how the job
+// was settled: "ack", "reject" or "requeue".
+const ResultAttribute = "messaging.result"
+
+// New returns a Broker propagating the trace context through the jobs of the
+// given Broker, exporting the producer and consumer spans to the Exporter.
+func New(b mq.Broker, e Exporter) mq.Broker {
+	return mq.WrapBroker(b, &broker{Broker: b, e: e})
+}
+
+type broker struct {
+	mq.Broker
+	e Exporter
+}
+
+// Queue implements the mq.Broker interface.
+func (b *broker) Queue(name string) (mq.Queue, error) {
+	q, err := b.Broker.Queue(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return mq.WrapQueue(q, &queue{Queue: q, name: name, e: b.e}), nil
+}
+
+type queue struct {
+	mq.Queue
+	name string
+	e    Exporter
+}
+
+// Publish implements the mq.Queue interface.
+func (q *queue) Publish(j *mq.Job) error {
+	if j == nil {
+		return q.Queue.Publish(j)
+	}
+
+	s := q.startProducer(j, 0)
+	err := q.Queue.Publish(j)
+	q.finish(s, err)
+	return err
+}
+
+// PublishDedup implements the mq.Deduplicator interface, the duplicates are
+// traced too.
+func (q *queue) PublishDedup(j *mq.Job) (bool, error) {
+	if j == nil {
+		return mq.PublishDedup(q.Queue, j)
+	}
+
+	s := q.startProducer(j, 0)
+	duplicate, err := mq.PublishDedup(q.Queue, j)
+	q.finish(s, err)
+	return duplicate, err
+}
+
+// PublishDelayed implements the mq.Queue interface.
+func (q *queue) PublishDelayed(j *mq.Job, delay time.Duration) error {
+	if j == nil {
+		return q.Queue.PublishDelayed(j, delay)
+	}
+
+	s := q.startProducer(j, delay)
+	err := q.Queue.PublishDelayed(j, delay)
+	q.finish(s, err)
+	return err
+}
+
+// Transaction implements the mq.Queue interface, the jobs published in the
+// transaction are traced too.
+func (q *queue) Transaction(txcb mq.TxCallback) error {
+	return q.Queue.Transaction(func(tx mq.Queue) error {
+		return txcb(mq.WrapQueue(tx, &queue{Queue: tx, name: q.name, e: q.e}))
+	})
+}
+
+// startProducer starts the producer span of the job, as a child of the span
+// context already in its headers, and writes it in the job.
+func (q *queue) startProducer(j *mq.Job, delay time.Duration) *Span {
+	s := &Span{
+		Name:  q.name + " publish",
+		Kind:  Producer,
+		Start: time.Now(),
+		Attributes: map[string]string{
+			QueueAttribute:     q.name,
+			JobIDAttribute:     j.ID,
+			OperationAttribute: "publish",
+		},
+	}
+
+	if delay > 0 {
+		s.Attributes[DelayAttribute] = delay.String()
+	}
+
+	if parent, ok := Extract(j); ok {
+		s.Parent = parent
+		s.Context = parent
+		s.Context.SpanID = newSpanID()
+	} else {
+		s.Context = SpanContext{
+			TraceID: newTraceID(),
+			SpanID:  newSpanID(),
+			Flags:   FlagSampled,
+		}
+	}
+
+	inject(s.Context, j)
+	return s
+}
+
+func (q *queue) finish(s *Span, err error) {
+	s.End = time.Now()
+	s.Err = err
+	q.e.ExportSpan(s)
+}
+
+// Consume implements the mq.Queue interface.
+func (q *queue) Consume(advertisedWindow int) (mq.JobIter, error) {
+	iter, err := q.Queue.Consume(advertisedWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jobIter{JobIter: iter, q: q}, nil
+}
+
+type jobIter struct {
+	mq.JobIter
+	q *queue
+}
+
+// Next implements the mq.JobIter interface.
+func (i *jobIter) Next() (*mq.Job, error) {
+	j, err := i.JobIter.Next()
+	if err != nil || j == nil {
+		return j, err
+	}
+
+	s := &Span{
+		Name:  i.q.name + " process",
+		Kind:  Consumer,
+		Start: time.Now(),
+		Attributes: map[string]string{
+			QueueAttribute:       i.q.name,
+			JobIDAttribute:       j.ID,
+			OperationAttribute:   "process",
+			DeliveriesAttribute:  strconv.Itoa(int(j.Deliveries)),
+			RedeliveredAttribute: strconv.FormatBool(j.Redelivered),
+		},
+	}
+
+	if producer, ok := Extract(j); ok {
+		s.Parent = producer
+		s.Links = []SpanContext{producer}
+		s.Context = producer
+		s.Context.SpanID = newSpanID()
+	} else {
+		s.Context = SpanContext{
+			TraceID: newTraceID(),
+			SpanID:  newSpanID(),
+			Flags:   FlagSampled,
+		}
+	}
+
+	j.Acknowledger = mq.WrapAcknowledger(j.Acknowledger,
+		&acknowledger{Acknowledger: j.Acknowledger, q: i.q, span: s})
+
+	return j, nil
+}
+
+type acknowledger struct {
+	mq.Acknowledger
+	q    *queue
+	span *Span
+	once sync.Once
+}
+
+// Ack implements the mq.Acknowledger interface.
+func (a *acknowledger) Ack() error {
+	err := a.Acknowledger.Ack()
+	a.end("ack", err)
+	return err
+}
+
+// Reject implements the mq.Acknowledger interface.
+func (a *acknowledger) Reject(requeue bool) error {
+	err := a.Acknowledger.Reject(requeue)
+	if requeue {
+		a.end("requeue", err)
+	} else {
+		a.end("reject", err)
+	}
+
+	return err
+}
+
+// end finishes the consumer span, only the first settlement is recorded.
+func (a *acknowledger) end(result string, err error) {
+	a.once.Do(func() {
+		a.span.Attributes[ResultAttribute] = result
+		a.q.finish(a.span, err)
+	})
+}
+
+// FromJob returns the SpanContext of the consumer span of a job delivered by
+// a queue of a Broker returned by New, even if the JobIter was wrapped again
+// afterwards.
+func FromJob(j *mq.Job) (SpanContext, bool) {
+	a, ok := mq.FindAcknowledger(j.Acknowledger, func(a mq.Acknowledger) bool {
+		_, ok := a.(*acknowledger)
+		return ok
+	})
+
+	if !ok {
+		return SpanContext{}, false
+	}
+
+	return a.(*acknowledger).span.Context, true
+}
+
+// ContextWithJob returns a copy of the context carrying the SpanContext of
+// the consumer span of the job, so the work done while handling it, including
+// the jobs published with Publish, belongs to the same trace. The context is
+// returned untouched if the job has no consumer span.
+func ContextWithJob(ctx context.Context, j *mq.Job) context.Context {
+	if sc, ok := FromJob(j); ok {
+		return ContextWithSpanContext(ctx, sc)
+	}
+
+	return ctx
+}
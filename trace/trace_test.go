@@ -0,0 +1,207 @@
+package trace
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+	"github.com/go-mq/mq/v2/poison"
+	"github.com/go-mq/mq/v2/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	require := require.New(t)
+
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(tp)
+	require.NoError(err)
+	require.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	require.Equal("00f067aa0ba902b7", sc.SpanID.String())
+	require.Equal(FlagSampled, sc.Flags)
+	require.Equal(tp, sc.Traceparent())
+
+	// later versions may add fields
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	require.NoError(err)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(invalid)
+		require.True(ErrInvalidTraceparent.Is(err), invalid)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	require := require.New(t)
+
+	r := NewRecorder()
+	q, err := New(memory.New(), r).Queue("traced")
+	require.NoError(err)
+
+	parent := SpanContext{
+		TraceID: newTraceID(),
+		SpanID:  newSpanID(),
+		Flags:   FlagSampled,
+		State:   "vendor=value",
+	}
+	ctx := ContextWithSpanContext(context.Background(), parent)
+
+	j := test.NewJob(t, true)
+	require.NoError(Publish(ctx, q, j))
+
+	spans := r.Spans()
+	require.Len(spans, 1)
+	producer := spans[0]
+	require.Equal(Producer, producer.Kind)
+	require.Equal(parent, producer.Parent)
+	require.Equal(parent.TraceID, producer.Context.TraceID)
+	require.NotEqual(parent.SpanID, producer.Context.SpanID)
+	require.Equal(producer.Context.Traceparent(), j.Headers[TraceparentHeader])
+	require.Equal("vendor=value", j.Headers[TracestateHeader])
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	// the first delivery is requeued and the second one acked
+	for _, result := range []string{"requeue", "ack"} {
+		j, err := iter.Next()
+		require.NoError(err)
+		require.True(j.CanExtend())
+
+		sc, ok := FromJob(j)
+		require.True(ok)
+		require.Equal(parent.TraceID, sc.TraceID)
+		require.Equal(sc, mustSpanContext(t, ContextWithJob(ctx, j)))
+
+		if result == "ack" {
+			require.NoError(j.Ack())
+		} else {
+			require.NoError(j.Reject(true))
+		}
+	}
+
+	spans = r.Spans()
+	require.Len(spans, 3)
+	for i, result := range []string{"requeue", "ack"} {
+		consumer := spans[i+1]
+		require.Equal(Consumer, consumer.Kind)
+		require.Equal(producer.Context, consumer.Parent)
+		require.Equal([]SpanContext{producer.Context}, consumer.Links)
+		require.Equal(parent.TraceID, consumer.Context.TraceID)
+		require.Equal(result, consumer.Attributes[ResultAttribute])
+		require.Equal(j.ID, consumer.Attributes[JobIDAttribute])
+		require.NoError(consumer.Err)
+	}
+
+	require.Equal("false", spans[1].Attributes[RedeliveredAttribute])
+	require.Equal("true", spans[2].Attributes[RedeliveredAttribute])
+}
+
+func TestFromJob_wrapped(t *testing.T) {
+	require := require.New(t)
+
+	q, err := New(memory.New(), NewRecorder()).Queue("traced")
+	require.NoError(err)
+	require.NoError(q.Publish(test.NewJob(t, true)))
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	// the JobIter is wrapped again by another package
+	j, err := poison.New(poison.Policy{}).Wrap(iter).Next()
+	require.NoError(err)
+
+	sc, ok := FromJob(j)
+	require.True(ok)
+	require.True(sc.IsValid())
+	require.NoError(j.Ack())
+
+	_, ok = FromJob(test.NewJob(t, true))
+	require.False(ok)
+}
+
+func TestPropagation_delayed(t *testing.T) {
+	require := require.New(t)
+
+	r := NewRecorder()
+	q, err := New(memory.New(), r).Queue("traced-delayed")
+	require.NoError(err)
+
+	// without a parent the producer span starts a new trace
+	j := test.NewJob(t, true)
+	require.NoError(q.PublishDelayed(j, 10*time.Millisecond))
+
+	spans := r.Spans()
+	require.Len(spans, 1)
+	producer := spans[0]
+	require.False(producer.Parent.IsValid())
+	require.True(producer.Context.IsValid())
+	require.Equal("10ms", producer.Attributes[DelayAttribute])
+
+	iter, err := q.Consume(0)
+	require.NoError(err)
+	defer iter.Close()
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.NoError(j.Reject(false))
+
+	spans = r.Spans()
+	require.Len(spans, 2)
+	require.Equal(producer.Context, spans[1].Parent)
+	require.Equal("reject", spans[1].Attributes[ResultAttribute])
+}
+
+func TestPropagation_transaction(t *testing.T) {
+	require := require.New(t)
+
+	r := NewRecorder()
+	q, err := New(memory.New(), r).Queue("traced-tx")
+	require.NoError(err)
+
+	j := test.NewJob(t, true)
+	require.NoError(q.Transaction(func(tx mq.Queue) error {
+		return tx.Publish(j)
+	}))
+
+	require.Len(r.Spans(), 1)
+	_, ok := Extract(j)
+	require.True(ok)
+}
+
+func mustSpanContext(t *testing.T, ctx context.Context) SpanContext {
+	sc, ok := SpanContextFromContext(ctx)
+	require.True(t, ok)
+	return sc
+}
+
+func TestCapabilities(t *testing.T) {
+	require := require.New(t)
+
+	b := New(memory.New(), NewRecorder())
+	require.Implements((*mq.Observable)(nil), b)
+	require.Implements((*mq.QueueDeleter)(nil), b)
+	require.Implements((*mq.TopicBroker)(nil), b)
+	require.Implements((*mq.LoggerSetter)(nil), b)
+
+	q, err := b.Queue("traced")
+	require.NoError(err)
+	require.Implements((*mq.Canceler)(nil), q)
+	require.Implements((*mq.Deduplicator)(nil), q)
+	require.Implements((*mq.DeadLetterer)(nil), q)
+	require.Implements((*mq.Inspector)(nil), q)
+}
@@ -0,0 +1,448 @@
+package workflow
+
+import (
+	"sort"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+)
+
+// Engine starts workflows and advances them as the jobs of their steps are
+// acknowledged or rejected.
+//
+// Only the jobs rejected without requeue through an iterator returned by Wrap
+// make their workflow fail. The jobs buried by the queue itself, such as
+// those whose lease expired too many times, fail their workflow only if the
+// Engine is also registered as a hook of the Broker, see mq.AddHook;
+// otherwise the workflow stays Running.
+type Engine struct {
+	b mq.Broker
+	s Store
+	// onFinish is called when a workflow succeeds or fails.
+	onFinish func(*Workflow)
+}
+
+// NewEngine returns an Engine publishing the jobs to the queues of the given
+// Broker and keeping the state of the workflows in the Store.
+func NewEngine(b mq.Broker, s Store) *Engine {
+	return &Engine{b: b, s: s}
+}
+
+// OnFinish sets the function called when a workflow succeeds or fails, with
+// a copy of the workflow. It is called once per workflow, after the
+// compensation jobs are published.
+func (e *Engine) OnFinish(fn func(*Workflow)) {
+	e.onFinish = fn
+}
+
+// Start validates the workflow, saves it and publishes the jobs of the steps
+// without requirements. If the jobs can't be published, the workflow is saved
+// as failed, with every step canceled, and the error is returned.
+func (e *Engine) Start(w *Workflow) error {
+	if err := w.validate(); err != nil {
+		return err
+	}
+
+	var roots []*Step
+	for _, s := range w.Steps {
+		if s.Pending == 0 {
+			s.State = Published
+			roots = append(roots, s)
+		}
+	}
+
+	w.Status = Running
+	w.Created = time.Now()
+	if err := e.s.Create(w); err != nil {
+		return err
+	}
+
+	perr := e.publishSteps(w.ID, roots)
+	if perr == nil {
+		return nil
+	}
+
+	var finished *Workflow
+	if err := e.s.Update(w.ID, func(w *Workflow) error {
+		w.Status = Failed
+		for _, s := range w.Steps {
+			s.State = Canceled
+		}
+
+		finished = nil
+		if e.finish(w) {
+			finished = w
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if finished != nil && e.onFinish != nil {
+		e.onFinish(finished)
+	}
+
+	return perr
+}
+
+// OnEvent implements the mq.Hook interface, the workflow of a step whose job
+// is buried fails. The errors of the Store are ignored, the hooks can't fail.
+// The jobs of the dead-letter queues are ignored, their step already failed.
+func (e *Engine) OnEvent(ev mq.Event) {
+	if ev.Transition != mq.Buried || ev.Job == nil || ev.Job.DeadLetterOrigin != "" {
+		return
+	}
+
+	id, step := ev.Job.Headers[WorkflowIDHeader], ev.Job.Headers[StepHeader]
+	if id == "" || step == "" {
+		return
+	}
+
+	e.fail(id, step)
+}
+
+// Status returns the current state of the workflow with the given ID.
+func (e *Engine) Status(id string) (*Workflow, error) {
+	return e.s.Get(id)
+}
+
+// Wrap returns a JobIter advancing the workflows of the jobs returned by the
+// given JobIter when they are acknowledged or rejected. The jobs not
+// belonging to a workflow are returned untouched.
+func (e *Engine) Wrap(iter mq.JobIter) mq.JobIter {
+	return &jobIter{JobIter: iter, e: e}
+}
+
+// ack marks the step as done and publishes the steps whose requirements are
+// all met. If the workflow already failed, the step is compensated instead.
+// The jobs are published once the workflow is saved; if they can't be, the
+// error is returned and they are published again when the step is
+// acknowledged again.
+func (e *Engine) ack(id, step string) error {
+	var (
+		finished      *Workflow
+		next          []*Step
+		compensations []*Step
+	)
+
+	err := e.s.Update(id, func(w *Workflow) error {
+		finished, next, compensations = nil, nil, nil
+		s, ok := w.Steps[step]
+		if !ok {
+			return nil
+		}
+
+		switch s.State {
+		case Published:
+		case Done:
+			// the successors may not have been published
+			for _, name := range w.Successors(step) {
+				if succ := w.Steps[name]; succ.State == Published {
+					next = append(next, succ)
+				}
+			}
+
+			return nil
+		case Compensated:
+			compensations = []*Step{s}
+			return nil
+		default:
+			return nil
+		}
+
+		s.State = Done
+		w.Completed = append(w.Completed, step)
+		if w.Status == Failed {
+			compensations = compensate(w, step)
+			if e.finish(w) {
+				finished = w
+			}
+
+			return nil
+		}
+
+		for _, name := range w.Successors(step) {
+			succ := w.Steps[name]
+			if succ.Pending--; succ.Pending == 0 {
+				succ.State = Published
+				next = append(next, succ)
+			}
+		}
+
+		if len(w.Completed) == len(w.Steps) {
+			w.Status = Succeeded
+			if e.finish(w) {
+				finished = w
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := e.publishSteps(id, next); err != nil {
+		return err
+	}
+
+	if err := e.publishCompensations(id, compensations); err != nil {
+		return err
+	}
+
+	if finished != nil && e.onFinish != nil {
+		e.onFinish(finished)
+	}
+
+	return nil
+}
+
+// fail marks the step and the workflow as failed, cancels the steps not
+// published yet and publishes the compensation jobs of the steps done, in
+// the reverse order. The compensation jobs are published once the workflow
+// is saved; if they can't be, the error is returned and they are published
+// again when the step is rejected again.
+func (e *Engine) fail(id, step string) error {
+	var (
+		finished      *Workflow
+		compensations []*Step
+	)
+
+	err := e.s.Update(id, func(w *Workflow) error {
+		finished, compensations = nil, nil
+		s, ok := w.Steps[step]
+		if !ok {
+			return nil
+		}
+
+		if s.State == StepFailed && w.Failure == step {
+			// the compensations may not have been published
+			for i := len(w.Completed) - 1; i >= 0; i-- {
+				if c := w.Steps[w.Completed[i]]; c.State == Compensated {
+					compensations = append(compensations, c)
+				}
+			}
+
+			return nil
+		}
+
+		if s.State != Published {
+			return nil
+		}
+
+		s.State = StepFailed
+		if w.Status == Failed {
+			if e.finish(w) {
+				finished = w
+			}
+
+			return nil
+		}
+
+		w.Status = Failed
+		w.Failure = step
+		for _, s := range w.Steps {
+			if s.State == Waiting {
+				s.State = Canceled
+			}
+		}
+
+		for i := len(w.Completed) - 1; i >= 0; i-- {
+			compensations = append(compensations, compensate(w, w.Completed[i])...)
+		}
+
+		if e.finish(w) {
+			finished = w
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := e.publishCompensations(id, compensations); err != nil {
+		return err
+	}
+
+	if finished != nil && e.onFinish != nil {
+		e.onFinish(finished)
+	}
+
+	return nil
+}
+
+// compensate marks a step done as compensated, if it has a compensation job.
+// It returns the step if it must be compensated.
+func compensate(w *Workflow, step string) []*Step {
+	s := w.Steps[step]
+	if s.State != Done || s.Compensation == nil {
+		return nil
+	}
+
+	s.State = Compensated
+	return []*Step{s}
+}
+
+// finish sets the finish time of a workflow that succeeded or failed and has
+// no published steps left. It returns true the first time.
+func (e *Engine) finish(w *Workflow) bool {
+	if w.Status == Running || !w.Finished.IsZero() {
+		return false
+	}
+
+	for _, s := range w.Steps {
+		if s.State == Published {
+			return false
+		}
+	}
+
+	w.Finished = time.Now()
+	return true
+}
+
+// publishSteps publishes the jobs of the given steps. The jobs of the same
+// queue are published in a transaction if the queue supports them. Their
+// DedupKey is derived from the workflow ID and the step, so the jobs
+// published again are dropped by the queues detecting duplicates.
+func (e *Engine) publishSteps(id string, steps []*Step) error {
+	byQueue := make(map[string][]*mq.Job)
+	var queues []string
+	for _, s := range steps {
+		if _, ok := byQueue[s.Queue]; !ok {
+			queues = append(queues, s.Queue)
+		}
+
+		j := withHeaders(s.Job, id, s.Name)
+		j.DedupKey = id + "/" + s.Name
+		byQueue[s.Queue] = append(byQueue[s.Queue], j)
+	}
+
+	sort.Strings(queues)
+	for _, name := range queues {
+		q, err := e.b.Queue(name)
+		if err != nil {
+			return err
+		}
+
+		if err := publish(q, byQueue[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishCompensations publishes the compensation jobs of the given steps, in
+// order.
+func (e *Engine) publishCompensations(id string, steps []*Step) error {
+	for _, s := range steps {
+		q, err := e.b.Queue(s.CompensationQueue)
+		if err != nil {
+			return err
+		}
+
+		j := withHeaders(s.Compensation, id, "")
+		j.DedupKey = id + "/" + s.Name + "/compensation"
+		if err := q.Publish(j); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func publish(q mq.Queue, jobs []*mq.Job) error {
+	err := q.Transaction(func(tx mq.Queue) error {
+		for _, j := range jobs {
+			if err := tx.Publish(j); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if !mq.ErrTxNotSupported.Is(err) {
+		return err
+	}
+
+	for _, j := range jobs {
+		if err := q.Publish(j); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// withHeaders returns a copy of the job with the workflow headers set.
+func withHeaders(j *mq.Job, id, step string) *mq.Job {
+	c := *j
+	c.Headers = make(map[string]string, len(j.Headers)+2)
+	for k, v := range j.Headers {
+		c.Headers[k] = v
+	}
+
+	c.Headers[WorkflowIDHeader] = id
+	if step != "" {
+		c.Headers[StepHeader] = step
+	}
+
+	return &c
+}
+
+type jobIter struct {
+	mq.JobIter
+	e *Engine
+}
+
+// Next implements the mq.JobIter interface.
+func (i *jobIter) Next() (*mq.Job, error) {
+	j, err := i.JobIter.Next()
+	if err != nil || j == nil {
+		return j, err
+	}
+
+	id, step := j.Headers[WorkflowIDHeader], j.Headers[StepHeader]
+	if id == "" || step == "" {
+		return j, nil
+	}
+
+	j.Acknowledger = mq.WrapAcknowledger(j.Acknowledger,
+		&acknowledger{Acknowledger: j.Acknowledger, e: i.e, id: id, step: step})
+
+	return j, nil
+}
+
+type acknowledger struct {
+	mq.Acknowledger
+	e        *Engine
+	id, step string
+}
+
+// Ack implements the mq.Acknowledger interface. The successors of the step
+// are published before acknowledging the job, if they can't be published the
+// job is not acknowledged and the error is returned.
+func (a *acknowledger) Ack() error {
+	if err := a.e.ack(a.id, a.step); err != nil {
+		return err
+	}
+
+	return a.Acknowledger.Ack()
+}
+
+// Reject implements the mq.Acknowledger interface. Rejecting the job without
+// requeuing it makes the workflow fail.
+func (a *acknowledger) Reject(requeue bool) error {
+	if !requeue {
+		if err := a.e.fail(a.id, a.step); err != nil {
+			return err
+		}
+	}
+
+	return a.Acknowledger.Reject(requeue)
+}
@@ -0,0 +1,92 @@
+package workflow
+
+import (
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Store keeps the state of the workflows.
+type Store interface {
+	// Create saves a new workflow, or returns ErrExists.
+	Create(*Workflow) error
+	// Get returns a copy of the workflow, or ErrNotFound.
+	Get(id string) (*Workflow, error)
+	// Update applies fn to the workflow and saves it atomically. If fn
+	// returns an error, nothing is saved and the error is returned.
+	Update(id string, fn func(*Workflow) error) error
+}
+
+// NewMemoryStore returns a Store keeping the workflows in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{workflows: make(map[string][]byte)}
+}
+
+// memoryStore keeps the workflows encoded, so every Get and Update works on
+// its own copy.
+type memoryStore struct {
+	mu        sync.Mutex
+	workflows map[string][]byte
+}
+
+// Create implements the Store interface.
+func (s *memoryStore) Create(w *Workflow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.workflows[w.ID]; ok {
+		return ErrExists.New(w.ID)
+	}
+
+	data, err := msgpack.Marshal(w)
+	if err != nil {
+		return err
+	}
+
+	s.workflows[w.ID] = data
+	return nil
+}
+
+// Get implements the Store interface.
+func (s *memoryStore) Get(id string) (*Workflow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(id)
+}
+
+func (s *memoryStore) get(id string) (*Workflow, error) {
+	data, ok := s.workflows[id]
+	if !ok {
+		return nil, ErrNotFound.New(id)
+	}
+
+	var w Workflow
+	if err := msgpack.Unmarshal(data, &w); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// Update implements the Store interface.
+func (s *memoryStore) Update(id string, fn func(*Workflow) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, err := s.get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(w); err != nil {
+		return err
+	}
+
+	data, err := msgpack.Marshal(w)
+	if err != nil {
+		return err
+	}
+
+	s.workflows[id] = data
+	return nil
+}
@@ -0,0 +1,253 @@
+// Package workflow implements workflows of jobs: directed acyclic graphs of
+// steps whose jobs are published once all the steps they require succeed.
+//
+// A step is a job to be published to a queue. When the job of a step is
+// acknowledged, the steps requiring it are notified and, once all their
+// requirements are met, their jobs are published. The jobs published by the
+// same acknowledgement to the same queue are published in a transaction, if
+// the queue supports them. When the job of a step is rejected without
+// requeuing it, the workflow fails: the steps not published yet are canceled
+// and the compensation jobs of the steps that already succeeded are published
+// in the reverse order.
+//
+// The jobs are published once the state of the workflow is saved, with a
+// DedupKey derived from the workflow ID and the step. If they can't be
+// published, the acknowledgement fails and they are published again when the
+// job is redelivered, so the queues should detect duplicates, see
+// mq.Deduplicator.
+//
+// The workflows are built entirely on mq.Job and mq.Queue: the jobs carry the
+// ID of their workflow and the name of their step in their headers, and the
+// consumers only need to wrap their JobIter with Engine.Wrap.
+package workflow
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+
+	"github.com/google/uuid"
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// Names of the job headers identifying the workflow and the step of a job.
+const (
+	WorkflowIDHeader = "workflow-id"
+	StepHeader       = "workflow-step"
+)
+
+var (
+	// ErrInvalidWorkflow is returned when starting a workflow with unknown
+	// requirements, cycles or steps without a job.
+	ErrInvalidWorkflow = errors.NewKind("invalid workflow: %s")
+	// ErrNotFound is returned when a workflow does not exist.
+	ErrNotFound = errors.NewKind("workflow %s not found")
+	// ErrExists is returned when starting a workflow whose ID is taken.
+	ErrExists = errors.NewKind("workflow %s already exists")
+)
+
+// Status is the status of a workflow.
+type Status int
+
+const (
+	// Running workflows have steps not finished yet.
+	Running Status = iota
+	// Succeeded workflows had all their steps succeeded.
+	Succeeded
+	// Failed workflows had a step failed.
+	Failed
+)
+
+// String returns the name of the Status.
+func (s Status) String() string {
+	switch s {
+	case Running:
+		return "running"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// StepState is the state of a step.
+type StepState int
+
+const (
+	// Waiting steps have requirements not succeeded yet.
+	Waiting StepState = iota
+	// Published steps have their job published and not finished yet.
+	Published
+	// Done steps had their job acknowledged.
+	Done
+	// StepFailed steps had their job rejected.
+	StepFailed
+	// Canceled steps were not published because the workflow failed.
+	Canceled
+	// Compensated steps were done and had their compensation job published
+	// because the workflow failed.
+	Compensated
+)
+
+// String returns the name of the StepState.
+func (s StepState) String() string {
+	switch s {
+	case Waiting:
+		return "waiting"
+	case Published:
+		return "published"
+	case Done:
+		return "done"
+	case StepFailed:
+		return "failed"
+	case Canceled:
+		return "canceled"
+	case Compensated:
+		return "compensated"
+	default:
+		return "unknown"
+	}
+}
+
+// Step is a job of a workflow.
+type Step struct {
+	Name string
+	// Queue is the name of the queue the job is published to.
+	Queue string
+	Job   *mq.Job
+	// Requires are the names of the steps that must succeed before this one
+	// is published.
+	Requires []string
+	// CompensationQueue and Compensation are the queue and the job published
+	// to undo the step if the workflow fails after it succeeded.
+	CompensationQueue string
+	Compensation      *mq.Job
+
+	State StepState
+	// Pending is the join counter, the number of required steps not
+	// succeeded yet.
+	Pending int
+}
+
+// CompensateWith sets the job published to the given queue to undo the step
+// if the workflow fails after it succeeded. It returns the step.
+func (s *Step) CompensateWith(queue string, j *mq.Job) *Step {
+	s.CompensationQueue = queue
+	s.Compensation = j
+	return s
+}
+
+// Workflow is a directed acyclic graph of steps.
+type Workflow struct {
+	ID     string
+	Steps  map[string]*Step
+	Status Status
+	// Completed are the names of the steps done, in the order they were
+	// acknowledged.
+	Completed []string
+	// Failure is the name of the step that made the workflow fail.
+	Failure  string
+	Created  time.Time
+	Finished time.Time
+}
+
+// New returns an empty Workflow with a new ID.
+func New() *Workflow {
+	return &Workflow{
+		ID:    uuid.New().String(),
+		Steps: make(map[string]*Step),
+	}
+}
+
+// Step adds a step publishing the job to the given queue once the required
+// steps succeed. It returns the step, so a compensation can be set.
+func (w *Workflow) Step(name, queue string, j *mq.Job, requires ...string) *Step {
+	s := &Step{Name: name, Queue: queue, Job: j, Requires: requires}
+	w.Steps[name] = s
+	return s
+}
+
+// Successors returns the names of the steps requiring the given step, sorted.
+func (w *Workflow) Successors(name string) []string {
+	var names []string
+	for _, s := range w.Steps {
+		for _, r := range s.Requires {
+			if r == name {
+				names = append(names, s.Name)
+				break
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// validate checks the steps and initializes their join counters.
+func (w *Workflow) validate() error {
+	if len(w.Steps) == 0 {
+		return ErrInvalidWorkflow.New("no steps")
+	}
+
+	for _, s := range w.Steps {
+		s.Pending = 0
+	}
+
+	for name, s := range w.Steps {
+		if s.Job == nil || s.Queue == "" {
+			return ErrInvalidWorkflow.New(fmt.Sprintf("step %s has no job or queue", name))
+		}
+
+		if (s.Compensation == nil) != (s.CompensationQueue == "") {
+			return ErrInvalidWorkflow.New(fmt.Sprintf("step %s has an incomplete compensation", name))
+		}
+
+		seen := make(map[string]bool)
+		for _, r := range s.Requires {
+			if _, ok := w.Steps[r]; !ok {
+				return ErrInvalidWorkflow.New(fmt.Sprintf("step %s requires unknown step %s", name, r))
+			}
+
+			if !seen[r] {
+				seen[r] = true
+				s.Pending++
+			}
+		}
+
+		s.Name = name
+		s.State = Waiting
+	}
+
+	// Kahn's algorithm, every step must be reachable from the roots
+	pending := make(map[string]int, len(w.Steps))
+	var ready []string
+	for name, s := range w.Steps {
+		pending[name] = s.Pending
+		if s.Pending == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	var visited int
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		visited++
+
+		for _, succ := range w.Successors(name) {
+			if pending[succ]--; pending[succ] == 0 {
+				ready = append(ready, succ)
+			}
+		}
+	}
+
+	if visited != len(w.Steps) {
+		return ErrInvalidWorkflow.New("cycle between steps")
+	}
+
+	return nil
+}
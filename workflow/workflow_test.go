@@ -0,0 +1,275 @@
+package workflow
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+	"github.com/go-mq/mq/v2/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkflow(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	e := NewEngine(b, NewMemoryStore())
+
+	var finished []*Workflow
+	e.OnFinish(func(w *Workflow) { finished = append(finished, w) })
+
+	w := New()
+	w.Step("fetch", "fetch", test.NewJob(t, "fetch"))
+	w.Step("parse-a", "parse", test.NewJob(t, "parse-a"), "fetch")
+	w.Step("parse-b", "parse", test.NewJob(t, "parse-b"), "fetch")
+	w.Step("index", "index", test.NewJob(t, "index"), "parse-a", "parse-b")
+	require.NoError(e.Start(w))
+
+	require.Equal([]string{"fetch"}, consume(t, b, e, "fetch", 0))
+	require.Equal([]string{"parse-a"}, consume(t, b, e, "parse", 1))
+
+	// index waits for both parse steps
+	require.Empty(consume(t, b, e, "index", 0))
+	status, err := e.Status(w.ID)
+	require.NoError(err)
+	require.Equal(Running, status.Status)
+	require.Equal(Waiting, status.Steps["index"].State)
+	require.Equal(1, status.Steps["index"].Pending)
+
+	require.Equal([]string{"parse-b"}, consume(t, b, e, "parse", 0))
+	require.Equal([]string{"index"}, consume(t, b, e, "index", 0))
+
+	status, err = e.Status(w.ID)
+	require.NoError(err)
+	require.Equal(Succeeded, status.Status)
+	require.Equal([]string{"fetch", "parse-a", "parse-b", "index"}, status.Completed)
+	require.False(status.Finished.IsZero())
+
+	require.Len(finished, 1)
+	require.Equal(w.ID, finished[0].ID)
+}
+
+func TestWorkflow_failure(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	e := NewEngine(b, NewMemoryStore())
+
+	var finished []*Workflow
+	e.OnFinish(func(w *Workflow) { finished = append(finished, w) })
+
+	w := New()
+	w.Step("reserve", "work", test.NewJob(t, "reserve")).
+		CompensateWith("undo", test.NewJob(t, "unreserve"))
+	w.Step("charge", "work", test.NewJob(t, "charge"), "reserve").
+		CompensateWith("undo", test.NewJob(t, "refund"))
+	w.Step("ship", "work", test.NewJob(t, "ship"), "charge")
+	w.Step("notify", "work", test.NewJob(t, "notify"), "ship")
+	require.NoError(e.Start(w))
+
+	require.Equal([]string{"reserve", "charge"}, consume(t, b, e, "work", 2))
+
+	q, err := b.Queue("work")
+	require.NoError(err)
+	iter, err := q.Consume(0)
+	require.NoError(err)
+
+	j, err := e.Wrap(iter).Next()
+	require.NoError(err)
+	require.Equal("ship", j.Headers[StepHeader])
+	require.NoError(j.Reject(false))
+	require.NoError(iter.Close())
+
+	status, err := e.Status(w.ID)
+	require.NoError(err)
+	require.Equal(Failed, status.Status)
+	require.Equal("ship", status.Failure)
+	require.Equal(Compensated, status.Steps["reserve"].State)
+	require.Equal(Compensated, status.Steps["charge"].State)
+	require.Equal(StepFailed, status.Steps["ship"].State)
+	require.Equal(Canceled, status.Steps["notify"].State)
+
+	// the compensations are published in the reverse order
+	require.Equal([]string{"refund", "unreserve"}, consume(t, b, e, "undo", 0))
+	require.Empty(consume(t, b, e, "work", 0))
+
+	require.Len(finished, 1)
+	require.Equal(Failed, finished[0].Status)
+}
+
+func TestWorkflow_buried(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.NewFinite(true)
+	e := NewEngine(b, NewMemoryStore())
+	b = mq.AddHook(b, e)
+
+	q, err := b.Queue("expiring")
+	require.NoError(err)
+	require.NoError(q.(mq.DeadLetterer).SetDeadLetter(mq.DeadLetterPolicy{MaxDeliveries: 1}))
+
+	w := New()
+	w.Step("slow", "expiring", test.NewJob(t, "slow"))
+	w.Step("next", "expiring", test.NewJob(t, "next"), "slow")
+	require.NoError(e.Start(w))
+
+	const timeout = 20 * time.Millisecond
+	iter, err := q.(*memory.Queue).ConsumeWithVisibility(0, timeout)
+	require.NoError(err)
+	defer iter.Close()
+
+	// the job is buried once its lease expires, without being rejected
+	j, err := e.Wrap(iter).Next()
+	require.NoError(err)
+	time.Sleep(2 * timeout)
+	require.True(mq.ErrLeaseExpired.Is(j.Ack()))
+
+	status, err := e.Status(w.ID)
+	require.NoError(err)
+	require.Equal(Failed, status.Status)
+	require.Equal("slow", status.Failure)
+	require.Equal(Canceled, status.Steps["next"].State)
+}
+
+func TestWorkflow_invalid(t *testing.T) {
+	require := require.New(t)
+
+	e := NewEngine(memory.New(), NewMemoryStore())
+
+	w := New()
+	require.True(ErrInvalidWorkflow.Is(e.Start(w)))
+
+	w.Step("a", "q", test.NewJob(t, "a"), "b")
+	w.Step("b", "q", test.NewJob(t, "b"), "a")
+	require.True(ErrInvalidWorkflow.Is(e.Start(w)))
+
+	w = New()
+	w.Step("a", "q", test.NewJob(t, "a"), "unknown")
+	require.True(ErrInvalidWorkflow.Is(e.Start(w)))
+
+	w = New()
+	w.Step("a", "q", test.NewJob(t, "a"))
+	require.NoError(e.Start(w))
+	require.True(ErrExists.Is(e.Start(w)))
+
+	_, err := e.Status("unknown")
+	require.True(ErrNotFound.Is(err))
+
+	// the join counters are computed again
+	w = New()
+	w.Step("a", "q", test.NewJob(t, "a"))
+	w.Step("b", "q", test.NewJob(t, "b"), "a")
+	require.NoError(w.validate())
+	require.NoError(w.validate())
+	require.Equal(1, w.Steps["b"].Pending)
+}
+
+// brokenBroker fails to return the broken queues.
+type brokenBroker struct {
+	mq.Broker
+
+	mu     sync.Mutex
+	broken map[string]bool
+}
+
+func (b *brokenBroker) Queue(name string) (mq.Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.broken[name] {
+		return nil, fmt.Errorf("queue %s is broken", name)
+	}
+
+	return b.Broker.Queue(name)
+}
+
+func (b *brokenBroker) fix(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.broken, name)
+}
+
+func TestWorkflow_publishFailed(t *testing.T) {
+	require := require.New(t)
+
+	b := &brokenBroker{
+		Broker: memory.NewFinite(true),
+		broken: map[string]bool{"index": true, "broken": true},
+	}
+	e := NewEngine(b, NewMemoryStore())
+
+	w := New()
+	w.Step("fetch", "fetch", test.NewJob(t, "fetch"))
+	w.Step("index", "index", test.NewJob(t, "index"), "fetch")
+	require.NoError(e.Start(w))
+
+	q, err := b.Queue("fetch")
+	require.NoError(err)
+	iter, err := q.Consume(0)
+	require.NoError(err)
+
+	j, err := e.Wrap(iter).Next()
+	require.NoError(err)
+	require.Error(j.Ack())
+	require.NoError(iter.Close())
+
+	status, err := e.Status(w.ID)
+	require.NoError(err)
+	require.Equal(Done, status.Steps["fetch"].State)
+	require.Equal(Published, status.Steps["index"].State)
+
+	// the successors are published when the job is acknowledged again
+	b.fix("index")
+	require.Equal([]string{"fetch"}, consume(t, b, e, "fetch", 0))
+	require.Equal([]string{"index"}, consume(t, b, e, "index", 0))
+
+	status, err = e.Status(w.ID)
+	require.NoError(err)
+	require.Equal(Succeeded, status.Status)
+
+	// a workflow whose jobs can't be published fails
+	w = New()
+	w.Step("a", "broken", test.NewJob(t, "a"))
+	w.Step("b", "fetch", test.NewJob(t, "b"), "a")
+	require.Error(e.Start(w))
+
+	status, err = e.Status(w.ID)
+	require.NoError(err)
+	require.Equal(Failed, status.Status)
+	require.Equal(Canceled, status.Steps["a"].State)
+	require.Equal(Canceled, status.Steps["b"].State)
+	require.False(status.Finished.IsZero())
+}
+
+// consume acknowledges the jobs in the queue, up to max if not 0, and returns
+// their payloads.
+func consume(t *testing.T, b mq.Broker, e *Engine, queue string, max int) []string {
+	q, err := b.Queue(queue)
+	require.NoError(t, err)
+
+	iter, err := q.Consume(0)
+	require.NoError(t, err)
+	defer iter.Close()
+
+	var payloads []string
+	iter = e.Wrap(iter)
+	for max == 0 || len(payloads) < max {
+		j, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+
+		var payload string
+		require.NoError(t, j.Decode(&payload))
+		require.NoError(t, j.Ack())
+		payloads = append(payloads, payload)
+	}
+
+	return payloads
+}
@@ -0,0 +1,254 @@
+package mq
+
+// WrapQueue returns a Queue publishing and consuming with w, a wrapper of the
+// Queue q, that keeps implementing the optional interfaces of q, Canceler,
+// Deduplicator, DeadLetterer and Inspector, unless w implements them itself.
+// It's the counterpart of WrapAcknowledger for the Brokers decorating the
+// queues of another Broker, so the decorators can be stacked in any order.
+func WrapQueue(q, w Queue) Queue {
+	c, cancels := w.(Canceler)
+	if !cancels {
+		c, cancels = q.(Canceler)
+	}
+
+	d, dedups := w.(Deduplicator)
+	if !dedups {
+		d, dedups = q.(Deduplicator)
+	}
+
+	l, deadLetters := w.(DeadLetterer)
+	if !deadLetters {
+		l, deadLetters = q.(DeadLetterer)
+	}
+
+	i, inspects := w.(Inspector)
+	if !inspects {
+		i, inspects = q.(Inspector)
+	}
+
+	switch {
+	case cancels && dedups && deadLetters && inspects:
+		return &struct {
+			Queue
+			Canceler
+			Deduplicator
+			DeadLetterer
+			Inspector
+		}{w, c, d, l, i}
+	case cancels && dedups && deadLetters:
+		return &struct {
+			Queue
+			Canceler
+			Deduplicator
+			DeadLetterer
+		}{w, c, d, l}
+	case cancels && dedups && inspects:
+		return &struct {
+			Queue
+			Canceler
+			Deduplicator
+			Inspector
+		}{w, c, d, i}
+	case cancels && deadLetters && inspects:
+		return &struct {
+			Queue
+			Canceler
+			DeadLetterer
+			Inspector
+		}{w, c, l, i}
+	case dedups && deadLetters && inspects:
+		return &struct {
+			Queue
+			Deduplicator
+			DeadLetterer
+			Inspector
+		}{w, d, l, i}
+	case cancels && dedups:
+		return &struct {
+			Queue
+			Canceler
+			Deduplicator
+		}{w, c, d}
+	case cancels && deadLetters:
+		return &struct {
+			Queue
+			Canceler
+			DeadLetterer
+		}{w, c, l}
+	case cancels && inspects:
+		return &struct {
+			Queue
+			Canceler
+			Inspector
+		}{w, c, i}
+	case dedups && deadLetters:
+		return &struct {
+			Queue
+			Deduplicator
+			DeadLetterer
+		}{w, d, l}
+	case dedups && inspects:
+		return &struct {
+			Queue
+			Deduplicator
+			Inspector
+		}{w, d, i}
+	case deadLetters && inspects:
+		return &struct {
+			Queue
+			DeadLetterer
+			Inspector
+		}{w, l, i}
+	case cancels:
+		return &struct {
+			Queue
+			Canceler
+		}{w, c}
+	case dedups:
+		return &struct {
+			Queue
+			Deduplicator
+		}{w, d}
+	case deadLetters:
+		return &struct {
+			Queue
+			DeadLetterer
+		}{w, l}
+	case inspects:
+		return &struct {
+			Queue
+			Inspector
+		}{w, i}
+	default:
+		return w
+	}
+}
+
+// WrapBroker returns a Broker opening its queues with w, a wrapper of the
+// Broker b, that keeps implementing the optional interfaces of b, Observable,
+// QueueDeleter, TopicBroker and LoggerSetter, unless w implements them itself.
+// The topics and the deletions of queues forwarded to b are not seen by w.
+func WrapBroker(b, w Broker) Broker {
+	o, observes := w.(Observable)
+	if !observes {
+		o, observes = b.(Observable)
+	}
+
+	d, deletes := w.(QueueDeleter)
+	if !deletes {
+		d, deletes = b.(QueueDeleter)
+	}
+
+	t, topics := w.(topicer)
+	if !topics {
+		t, topics = b.(topicer)
+	}
+
+	l, logs := w.(LoggerSetter)
+	if !logs {
+		l, logs = b.(LoggerSetter)
+	}
+
+	switch {
+	case observes && deletes && topics && logs:
+		return &struct {
+			Broker
+			Observable
+			QueueDeleter
+			topicer
+			LoggerSetter
+		}{w, o, d, t, l}
+	case observes && deletes && topics:
+		return &struct {
+			Broker
+			Observable
+			QueueDeleter
+			topicer
+		}{w, o, d, t}
+	case observes && deletes && logs:
+		return &struct {
+			Broker
+			Observable
+			QueueDeleter
+			LoggerSetter
+		}{w, o, d, l}
+	case observes && topics && logs:
+		return &struct {
+			Broker
+			Observable
+			topicer
+			LoggerSetter
+		}{w, o, t, l}
+	case deletes && topics && logs:
+		return &struct {
+			Broker
+			QueueDeleter
+			topicer
+			LoggerSetter
+		}{w, d, t, l}
+	case observes && deletes:
+		return &struct {
+			Broker
+			Observable
+			QueueDeleter
+		}{w, o, d}
+	case observes && topics:
+		return &struct {
+			Broker
+			Observable
+			topicer
+		}{w, o, t}
+	case observes && logs:
+		return &struct {
+			Broker
+			Observable
+			LoggerSetter
+		}{w, o, l}
+	case deletes && topics:
+		return &struct {
+			Broker
+			QueueDeleter
+			topicer
+		}{w, d, t}
+	case deletes && logs:
+		return &struct {
+			Broker
+			QueueDeleter
+			LoggerSetter
+		}{w, d, l}
+	case topics && logs:
+		return &struct {
+			Broker
+			topicer
+			LoggerSetter
+		}{w, t, l}
+	case observes:
+		return &struct {
+			Broker
+			Observable
+		}{w, o}
+	case deletes:
+		return &struct {
+			Broker
+			QueueDeleter
+		}{w, d}
+	case topics:
+		return &struct {
+			Broker
+			topicer
+		}{w, t}
+	case logs:
+		return &struct {
+			Broker
+			LoggerSetter
+		}{w, l}
+	default:
+		return w
+	}
+}
+
+// topicer is the method added by TopicBroker to Broker, embedding TopicBroker
+// along with Broker would make their methods ambiguous.
+type topicer interface {
+	Topic(string) (Topic, error)
+}
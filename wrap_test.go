@@ -0,0 +1,71 @@
+package mq_test
+
+import (
+	"testing"
+
+	"github.com/go-mq/mq/v2"
+	"github.com/go-mq/mq/v2/memory"
+
+	"github.com/stretchr/testify/require"
+)
+
+type plainQueue struct {
+	mq.Queue
+}
+
+type plainBroker struct {
+	mq.Broker
+}
+
+type cancelingQueue struct {
+	mq.Queue
+	canceled []string
+}
+
+func (q *cancelingQueue) Cancel(id string) (bool, error) {
+	q.canceled = append(q.canceled, id)
+	return true, nil
+}
+
+func TestWrapQueue(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.New().Queue("wrap")
+	require.NoError(err)
+
+	// the wrapper cancels itself and forwards the rest
+	w := &cancelingQueue{Queue: q}
+	wrapped := mq.WrapQueue(q, w)
+	require.Implements((*mq.Deduplicator)(nil), wrapped)
+	require.Implements((*mq.DeadLetterer)(nil), wrapped)
+	require.Implements((*mq.Inspector)(nil), wrapped)
+
+	ok, err := mq.Cancel(wrapped, "foo")
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]string{"foo"}, w.canceled)
+
+	// nothing is claimed that the wrapped queue does not implement
+	wrapped = mq.WrapQueue(plainQueue{q}, plainQueue{q})
+	_, ok = wrapped.(mq.Canceler)
+	require.False(ok)
+	_, ok = wrapped.(mq.Inspector)
+	require.False(ok)
+}
+
+func TestWrapBroker(t *testing.T) {
+	require := require.New(t)
+
+	b := memory.New()
+	wrapped := mq.WrapBroker(b, plainBroker{b})
+	require.Implements((*mq.Observable)(nil), wrapped)
+	require.Implements((*mq.QueueDeleter)(nil), wrapped)
+	require.Implements((*mq.TopicBroker)(nil), wrapped)
+	require.Implements((*mq.LoggerSetter)(nil), wrapped)
+
+	wrapped = mq.WrapBroker(plainBroker{b}, plainBroker{b})
+	_, ok := wrapped.(mq.QueueDeleter)
+	require.False(ok)
+	_, ok = wrapped.(mq.TopicBroker)
+	require.False(ok)
+}